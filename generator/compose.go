@@ -0,0 +1,178 @@
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"markmach/retrieval"
+	"markmach/trainer"
+)
+
+// Сколько найденных предложений рассматривать на каждое предложение ответа
+const sourcesPerSentence = 3
+
+// Предложения с большей долей общих слов считаются повтором
+const duplicateOverlap = 0.6
+
+// Целевая длина ответа. Нулевое значение — одно предложение
+type AnswerLength struct {
+	Sentences  int // Сколько предложений в ответе (0 — одно, если не задан Characters, иначе без предела)
+	Characters int // Предельная длина ответа в символах (0 — без предела)
+}
+
+// Проверка целевой длины
+func (l AnswerLength) Validate() error {
+	if l.Sentences < 0 || l.Characters < 0 {
+		return fmt.Errorf("answer length must not be negative, got %d sentences and %d characters", l.Sentences, l.Characters)
+	}
+	return nil
+}
+
+// Нужно ли больше одного предложения
+func (l AnswerLength) multi() bool {
+	return l.Sentences > 1 || l.Characters > 0
+}
+
+// Предложение, которое может войти в ответ
+type answerSentence struct {
+	text     string
+	tokens   map[string]bool
+	doc      int     // Номер исходного предложения в индексе: порядок в корпусе
+	affinity float64 // Сходство исходного предложения с темой вопроса
+}
+
+// Дополняем ответ предложениями, построенными от других найденных
+// предложений: сначала берутся те, что добавляют больше новых ключевых
+// слов и ближе к теме вопроса, затем они выстраиваются в порядке корпуса.
+// Первое предложение ответа остается первым. Ищутся все ключевые слова
+// вопроса, а не только тематические, чтобы было из чего выбирать
+func (g *AnswerGenerator) composeAnswer(answer Answer, keywords []string) Answer {
+	length := g.current.length
+	if !length.multi() || answer.Text == "" {
+		return answer
+	}
+
+	limit := max(length.Sentences, 1) * sourcesPerSentence
+	if length.Sentences == 0 {
+		limit = max(length.Characters/40, 1) * sourcesPerSentence
+	}
+
+	chosen := []answerSentence{{text: answer.Text, tokens: g.tokenSet(answer.Text), doc: -1}}
+	covered := make(map[string]bool)
+	for token := range chosen[0].tokens {
+		covered[token] = true
+	}
+	characters := utf8.RuneCountInString(answer.Text)
+
+	searchKeywords := normalizeWords(append(append([]string{}, keywords...), g.current.constraints.Required...))
+	candidates := g.sentenceCandidates(g.chain.SearchTopicResults(searchKeywords, g.topic, limit), keywords)
+	for length.Sentences == 0 || len(chosen) < length.Sentences {
+		best := -1
+		bestGain := 0
+		for i, candidate := range candidates {
+			if g.isDuplicate(candidate, chosen) {
+				continue
+			}
+			if length.Characters > 0 && characters+1+utf8.RuneCountInString(candidate.text) > length.Characters {
+				continue
+			}
+			gain := 0
+			for _, keyword := range keywords {
+				if candidate.tokens[keyword] && !covered[keyword] {
+					gain++
+				}
+			}
+			if best < 0 || gain > bestGain || gain == bestGain && candidate.affinity > candidates[best].affinity {
+				best, bestGain = i, gain
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		sentence := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		chosen = append(chosen, sentence)
+		for token := range sentence.tokens {
+			covered[token] = true
+		}
+		characters += 1 + utf8.RuneCountInString(sentence.text)
+	}
+	if len(chosen) == 1 {
+		return answer
+	}
+
+	rest := chosen[1:]
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].doc < rest[j].doc
+	})
+	texts := make([]string, len(chosen))
+	for i, sentence := range chosen {
+		texts[i] = sentence.text
+	}
+
+	answer.Text = strings.Join(texts, " ")
+	answer.Score = g.scoreAnswer(answer.Text, keywords)
+	fmt.Printf("Composed answer from %d sentences\n", len(chosen))
+	return answer
+}
+
+// Предложения для ответа: продолжение каждого найденного предложения по
+// цепи, а если оно не прошло проверки — само найденное предложение.
+// Дословные предложения корпуса не берутся при защите от копирования,
+// а предложения, которыми уже отвечали в диалоге, не берутся вовсе
+func (g *AnswerGenerator) sentenceCandidates(results []retrieval.Result, keywords []string) []answerSentence {
+	var candidates []answerSentence
+	for _, result := range results {
+		text := g.formatAnswer(g.generateFromSentence(result.Document.Text, keywords))
+		if text == "" || g.containsBanned(g.tokenizer.Tokenize(text)) || !g.isNovel(text) || g.current.dialogue.repeats(text) {
+			text = g.formatAnswer(result.Document.Text)
+			if g.containsBanned(g.tokenizer.Tokenize(text)) || g.current.novelty.enabled() || g.current.dialogue.repeats(text) {
+				continue
+			}
+		}
+
+		affinity := 0.0
+		if g.topic != nil && result.Doc < len(g.chain.TopicModel.Mixtures) {
+			affinity = trainer.TopicSimilarity(g.chain.TopicModel.Mixtures[result.Doc], g.topic)
+		}
+		candidates = append(candidates, answerSentence{
+			text:     text,
+			tokens:   g.tokenSet(text),
+			doc:      result.Doc,
+			affinity: affinity,
+		})
+	}
+	return candidates
+}
+
+// Слова текста без служебных токенов и знаков препинания
+func (g *AnswerGenerator) tokenSet(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, token := range g.tokenizer.Tokenize(text) {
+		if token != "<start>" && token != "<end>" && !isPunctuation(token) {
+			tokens[token] = true
+		}
+	}
+	return tokens
+}
+
+// Повторяет ли предложение уже выбранное: доля общих слов от меньшего
+// из предложений больше порога
+func (g *AnswerGenerator) isDuplicate(candidate answerSentence, chosen []answerSentence) bool {
+	for _, sentence := range chosen {
+		common := 0
+		for token := range candidate.tokens {
+			if sentence.tokens[token] {
+				common++
+			}
+		}
+		smaller := min(len(candidate.tokens), len(sentence.tokens))
+		if smaller == 0 || float64(common)/float64(smaller) > duplicateOverlap {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package generator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Сколько найденных предложений проверять на соответствие ограничениям
+const constrainedSearchLimit = 20
+
+// Ответ с заданными ограничениями получить не удалось
+var ErrConstraintsUnsatisfied = errors.New("constraints cannot be satisfied")
+
+// Лексические ограничения ответа
+type Constraints struct {
+	Required   []string // Слова, которые обязательно должны быть в ответе
+	Banned     []string // Слова, которых в ответе быть не должно
+	MaxRetries int      // Число повторных попыток, если ни один кандидат не подошел
+}
+
+// Есть ли ограничения
+func (c Constraints) empty() bool {
+	return len(c.Required) == 0 && len(c.Banned) == 0
+}
+
+// Ограничения с приведенными к нижнему регистру словами без повторов
+func (c Constraints) normalized() Constraints {
+	c.Required = normalizeWords(c.Required)
+	c.Banned = normalizeWords(c.Banned)
+	return c
+}
+
+// Проверка ограничений: обязательное слово не может быть запрещенным
+func (c Constraints) Validate() error {
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("number of retries must not be negative, got %d", c.MaxRetries)
+	}
+
+	banned := make(map[string]bool)
+	for _, word := range normalizeWords(c.Banned) {
+		banned[word] = true
+	}
+	for _, word := range normalizeWords(c.Required) {
+		if banned[word] {
+			return fmt.Errorf("word %q is both required and banned", word)
+		}
+	}
+	return nil
+}
+
+// Слова в нижнем регистре без пустых и повторов
+func normalizeWords(words []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" && !seen[word] {
+			seen[word] = true
+			result = append(result, word)
+		}
+	}
+	return result
+}
+
+// Загрузка списка слов из файла: слова разделяются пробелами, запятыми
+// или переводами строк, строки с # — комментарии
+func LoadWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open word list: %w", err)
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read word list: %w", err)
+	}
+
+	return normalizeWords(words), nil
+}
+
+// Обязательные слова, которых нет в словаре модели: с ними ответ невозможен
+func (g *AnswerGenerator) unknownRequired() []string {
+	var unknown []string
+	for _, word := range g.current.constraints.Required {
+		if _, exists := g.chain.Vocab[word]; !exists {
+			unknown = append(unknown, word)
+		}
+	}
+	return unknown
+}
+
+// Запрещено ли слово ограничениями текущего запроса
+func (g *AnswerGenerator) isBanned(token string) bool {
+	return g.current.banned[token]
+}
+
+// Содержит ли последовательность запрещенные слова
+func (g *AnswerGenerator) containsBanned(tokens []string) bool {
+	for _, token := range tokens {
+		if g.isBanned(token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Удовлетворяет ли текст ответа ограничениям текущего запроса
+func (g *AnswerGenerator) satisfiesConstraints(text string) bool {
+	tokens := g.tokenizer.Tokenize(text)
+	if g.containsBanned(tokens) {
+		return false
+	}
+
+	present := make(map[string]bool)
+	for _, token := range tokens {
+		present[token] = true
+	}
+	for _, word := range g.current.constraints.Required {
+		if !present[word] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,353 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Способы поиска ответа
+const (
+	DecodeSample = "sample" // Одно случайное блуждание по цепи
+	DecodeNBest  = "nbest"  // N случайных блужданий, выбирается лучший по оценке
+	DecodeBeam   = "beam"   // Лучевой поиск шириной N
+)
+
+// Число кандидатов по умолчанию для nbest и beam
+const defaultCandidates = 5
+
+// Нижняя граница вероятности токена при оценке, чтобы не получить -Inf
+const minTokenProbability = 1e-10
+
+// Настройки поиска ответа
+type Decoding struct {
+	Mode       string       // sample, nbest или beam ("" — sample)
+	Candidates int          // Число кандидатов для nbest и ширина луча для beam (0 — 5)
+	Weights    ScoreWeights // Веса оценки кандидатов (нулевые — по умолчанию)
+}
+
+// Веса составляющих оценки кандидата
+type ScoreWeights struct {
+	LogProb       float64 // Вес нормированной log-вероятности по модели
+	Coverage      float64 // Вес доли ключевых слов вопроса, вошедших в ответ
+	Novelty       float64 // Вес доли N-грамм ответа, которых нет в корпусе дословно
+	LengthPenalty float64 // Степень длины при нормировке log-вероятности: 0 — сумма, 1 — среднее
+}
+
+// Оценка кандидата
+type Score struct {
+	Total    float64
+	LogProb  float64 // Суммарная log-вероятность ответа по модели
+	Tokens   int     // Число предсказанных токенов
+	Coverage float64
+	Novelty  float64
+	Copied   int // Длина самого длинного фрагмента, скопированного из корпуса (0 — нет или набора N-грамм нет)
+}
+
+// Кандидат лучевого поиска
+type hypothesis struct {
+	tokens  []string
+	logProb float64
+	steps   int
+}
+
+// Веса оценки по умолчанию
+func DefaultScoreWeights() ScoreWeights {
+	return ScoreWeights{
+		LogProb:       1,
+		Coverage:      2,
+		Novelty:       0.5,
+		LengthPenalty: 1,
+	}
+}
+
+// Проверка настроек поиска ответа
+func (d Decoding) Validate() error {
+	switch d.Mode {
+	case "", DecodeSample, DecodeNBest, DecodeBeam:
+	default:
+		return fmt.Errorf("unknown decoding mode %q (expected %q, %q or %q)", d.Mode, DecodeSample, DecodeNBest, DecodeBeam)
+	}
+	if d.Candidates < 0 {
+		return fmt.Errorf("number of candidates must not be negative, got %d", d.Candidates)
+	}
+	w := d.Weights
+	if w.LogProb < 0 || w.Coverage < 0 || w.Novelty < 0 || w.LengthPenalty < 0 {
+		return fmt.Errorf("score weights must not be negative, got %+v", w)
+	}
+	return nil
+}
+
+// Настройки с подставленными значениями по умолчанию
+func (d Decoding) withDefaults() Decoding {
+	if d.Mode == "" {
+		d.Mode = DecodeSample
+	}
+	if d.Candidates == 0 {
+		d.Candidates = defaultCandidates
+	}
+	if d.Weights == (ScoreWeights{}) {
+		d.Weights = DefaultScoreWeights()
+	}
+	return d
+}
+
+// Кандидаты ответа по режиму поиска текущего запроса
+func (g *AnswerGenerator) generateCandidates(keywords []string) []string {
+	decoding := g.current.decoding
+
+	switch decoding.Mode {
+	case DecodeBeam:
+		return g.beamAnswers(keywords, decoding.Candidates)
+
+	case DecodeNBest:
+		var candidates []string
+		for i := 0; i < decoding.Candidates; i++ {
+			if answer := g.sampleAnswer(keywords); answer != "" {
+				candidates = append(candidates, answer)
+			}
+		}
+		return candidates
+
+	default:
+		if answer := g.sampleAnswer(keywords); answer != "" {
+			return []string{answer}
+		}
+		return nil
+	}
+}
+
+// Ответы лучевым поиском от того же начала, что и у случайного блуждания:
+// окна с ключевым словом или тематического начала релевантного предложения
+func (g *AnswerGenerator) beamAnswers(keywords []string, width int) []string {
+	if g.chain.Backward != nil {
+		if keyword := g.anchorKeyword(keywords); keyword != "" {
+			if window := g.findKeywordWindow(keyword); len(window) > 0 {
+				var answers []string
+				for _, tokens := range g.beamSearch(window, keywords, width) {
+					answers = append(answers, g.tokenizer.JoinTokens(g.extendBackward(tokens, keywords)))
+				}
+				return answers
+			}
+		}
+	}
+
+	sentence := g.relevantSentence(keywords)
+	if sentence == "" {
+		return nil
+	}
+	var tokens []string
+	for _, token := range g.tokenizer.Tokenize(sentence) {
+		if token != "<start>" && token != "<end>" {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return []string{sentence}
+	}
+
+	startPos := g.findThematicStartPosition(tokens, keywords)
+	start := tokens[g.copiedPrefixStart(startPos):min(startPos+g.chain.Order-1, len(tokens))]
+
+	var answers []string
+	for _, hypothesis := range g.beamSearch(start, keywords, width) {
+		answers = append(answers, g.tokenizer.JoinTokens(hypothesis))
+	}
+	return answers
+}
+
+// Лучевой поиск продолжений: на каждом шаге каждый кандидат расширяется
+// самыми вероятными токенами, и остаются width лучших по средней
+// log-вероятности. Кандидат завершается на <end> или предельной длине.
+// Вероятности берутся из модели, как в scoreAnswer, а не из весов
+// сэмплирования: температура и отсечения top-k/top-p/min-p относятся только
+// к случайному выбору. Запреты повторов и копирования соблюдаются
+func (g *AnswerGenerator) beamSearch(start []string, keywords []string, width int) [][]string {
+	beam := []hypothesis{{tokens: start}}
+	var finished []hypothesis
+
+	for len(beam) > 0 {
+		var next []hypothesis
+		for _, h := range beam {
+			if len(h.tokens) >= g.maxLength || h.tokens[len(h.tokens)-1] == "<end>" {
+				finished = append(finished, h)
+				continue
+			}
+
+			weights, _ := g.nextWeights(g.chain, h.tokens, keywords)
+			candidates := g.modelCandidates(h.tokens, weights)
+			if len(candidates) == 0 {
+				finished = append(finished, h)
+				continue
+			}
+
+			for _, c := range candidates[:min(width, len(candidates))] {
+				extended := hypothesis{
+					tokens:  h.tokens,
+					logProb: h.logProb + math.Log(c.weight),
+					steps:   h.steps + 1,
+				}
+				if c.token == "<end>" {
+					finished = append(finished, extended)
+					continue
+				}
+				extended.tokens = append(append([]string{}, h.tokens...), c.token)
+				next = append(next, extended)
+			}
+		}
+
+		sortHypotheses(next)
+		beam = next[:min(width, len(next))]
+	}
+
+	sortHypotheses(finished)
+	var results [][]string
+	for _, h := range finished[:min(width, len(finished))] {
+		results = append(results, h.tokens)
+	}
+	return results
+}
+
+// Допустимые продолжения истории с вероятностями по модели, от самого
+// вероятного; при равенстве — по алфавиту
+func (g *AnswerGenerator) modelCandidates(history []string, weights map[string]float64) []candidate {
+	context := history[max(0, len(history)-g.chain.Order+1):]
+	candidates := make([]candidate, 0, len(weights))
+	for token := range weights {
+		probability := math.Max(g.chain.Probability(context, token), minTokenProbability)
+		candidates = append(candidates, candidate{token: token, weight: probability})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].weight != candidates[j].weight {
+			return candidates[i].weight > candidates[j].weight
+		}
+		return candidates[i].token < candidates[j].token
+	})
+	return candidates
+}
+
+// Сортировка кандидатов по средней log-вероятности шага, при равенстве — по тексту
+func sortHypotheses(hypotheses []hypothesis) {
+	average := func(h hypothesis) float64 {
+		return h.logProb / float64(max(h.steps, 1))
+	}
+	sort.SliceStable(hypotheses, func(i, j int) bool {
+		a, b := average(hypotheses[i]), average(hypotheses[j])
+		if a != b {
+			return a > b
+		}
+		return strings.Join(hypotheses[i].tokens, " ") < strings.Join(hypotheses[j].tokens, " ")
+	})
+}
+
+// Выбираем кандидата с лучшей оценкой; одинаковые ответы сравниваются один раз
+func (g *AnswerGenerator) rerank(candidates []string, keywords []string) Answer {
+	seen := make(map[string]bool)
+	var best Answer
+	for _, candidate := range candidates {
+		text := g.formatAnswer(candidate)
+		if seen[text] {
+			continue
+		}
+		seen[text] = true
+
+		score := g.scoreAnswer(text, keywords)
+		if best.Candidates == 0 || score.Total > best.Score.Total {
+			best.Text = text
+			best.Score = score
+		}
+		best.Candidates++
+	}
+
+	if best.Candidates > 1 {
+		fmt.Printf("Compared %d candidates (%s)\n", best.Candidates, g.current.decoding.Mode)
+	}
+	return best
+}
+
+// Оценка ответа: нормированная на длину log-вероятность по модели, покрытие
+// ключевых слов вопроса и новизна относительно корпуса: по набору N-грамм
+// модели, если он есть, иначе по поисковому индексу
+func (g *AnswerGenerator) scoreAnswer(text string, keywords []string) Score {
+	tokens := g.tokenizer.Tokenize(text)
+	weights := g.current.decoding.Weights
+
+	var score Score
+	for i := 1; i < len(tokens); i++ {
+		context := tokens[max(0, i-g.chain.Order+1):i]
+		probability := math.Max(g.chain.Probability(context, tokens[i]), minTokenProbability)
+		score.LogProb += math.Log(probability)
+		score.Tokens++
+	}
+
+	present := make(map[string]bool)
+	for _, token := range tokens {
+		present[token] = true
+	}
+	unique := make(map[string]bool)
+	covered := 0
+	for _, keyword := range keywords {
+		if unique[keyword] {
+			continue
+		}
+		unique[keyword] = true
+		if present[keyword] {
+			covered++
+		}
+	}
+	if len(unique) > 0 {
+		score.Coverage = float64(covered) / float64(len(unique))
+	}
+
+	if g.chain.Ngrams != nil {
+		score.Copied, score.Novelty = g.chain.Ngrams.Copied(tokens)
+	} else {
+		score.Novelty = g.novelty(tokens)
+	}
+
+	normalized := 0.0
+	if score.Tokens > 0 {
+		normalized = score.LogProb / math.Pow(float64(score.Tokens), weights.LengthPenalty)
+	}
+	score.Total = weights.LogProb*normalized + weights.Coverage*score.Coverage + weights.Novelty*score.Novelty
+	return score
+}
+
+// Доля окон из Order+1 слов ответа, которые не встречаются в корпусе
+// дословно. Окна со знаками препинания не учитываются; если окон нет,
+// ответ короче окна и скопирован быть не может, поэтому новизна 1
+func (g *AnswerGenerator) novelty(tokens []string) float64 {
+	size := g.chain.Order + 1
+	var words []string
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" {
+			words = append(words, token)
+		}
+	}
+
+	windows, copied := 0, 0
+	for i := 0; i+size <= len(words); i++ {
+		window := words[i : i+size]
+		punctuation := false
+		for _, word := range window {
+			if isPunctuation(word) {
+				punctuation = true
+				break
+			}
+		}
+		if punctuation {
+			continue
+		}
+
+		windows++
+		if len(g.chain.Index.Phrase(window)) > 0 {
+			copied++
+		}
+	}
+
+	if windows == 0 {
+		return 1
+	}
+	return 1 - float64(copied)/float64(windows)
+}
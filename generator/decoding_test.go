@@ -0,0 +1,31 @@
+package generator
+
+import (
+	"testing"
+
+	"markmach/trainer"
+)
+
+// Лучевой поиск не зависит от фильтров сэмплирования: с --greedy луч
+// остается широким, а кандидаты упорядочены по вероятности модели
+func TestBeamSearchIgnoresSamplingFilters(t *testing.T) {
+	chain := testChain(t, trainer.TrainConfig{Order: 2})
+	g := testGenerator(chain, 1)
+	g.current.sampling = Sampling{Greedy: true}
+
+	start := []string{"<start>", "модель"}
+	results := g.beamSearch(start, nil, 3)
+	if len(results) != 3 {
+		t.Fatalf("greedy beam of width 3 gave %d candidates", len(results))
+	}
+
+	candidates := g.modelCandidates(start, chain.GetNextTokens(start[1:]))
+	for i := 1; i < len(candidates); i++ {
+		if candidates[i].weight > candidates[i-1].weight {
+			t.Fatalf("candidates are not ordered by model probability: %v", candidates)
+		}
+	}
+	if first := candidates[0]; first.weight != chain.Probability(start[1:], first.token) {
+		t.Fatalf("candidate %q has weight %g, model probability %g", first.token, first.weight, chain.Probability(start[1:], first.token))
+	}
+}
@@ -0,0 +1,149 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Ключевые слова контекста с меньшим весом забываются
+const minContextWeight = 0.1
+
+// Сколько ключевых слов контекста подставлять в уточняющий вопрос
+const contextKeywords = 5
+
+// Граница предложений в тексте ответа
+var sentenceBoundary = regexp.MustCompile(`[.!?…]+\s+`)
+
+// Состояние диалога: ключевые слова и тема прошлых вопросов с затуханием
+// и уже данные ответы
+type Dialogue struct {
+	Decay float64 // Во сколько раз ослабевает вес прошлых ключевых слов и темы за ход
+
+	keywords map[string]float64 // Ключевое слово -> вес
+	topic    []float64          // Смесь тем прошлых вопросов
+	answered map[string]bool    // Предложения, которыми уже отвечали
+}
+
+// Новый диалог; decay от 0 до 1
+func NewDialogue(decay float64) (*Dialogue, error) {
+	if decay <= 0 || decay >= 1 {
+		return nil, fmt.Errorf("memory decay must be between 0 and 1, got %g", decay)
+	}
+	d := &Dialogue{Decay: decay}
+	d.Reset()
+	return d, nil
+}
+
+// Забываем контекст и данные ответы
+func (d *Dialogue) Reset() {
+	d.keywords = make(map[string]float64)
+	d.topic = nil
+	d.answered = make(map[string]bool)
+}
+
+// Ключевые слова контекста по убыванию веса
+func (d *Dialogue) Keywords() []string {
+	words := make([]string, 0, len(d.keywords))
+	for word := range d.keywords {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if d.keywords[words[i]] != d.keywords[words[j]] {
+			return d.keywords[words[i]] > d.keywords[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	return words
+}
+
+// Запоминаем ход: прошлые веса затухают, слова вопроса получают вес 1
+func (d *Dialogue) remember(keywords []string, topic []float64, answer string) {
+	for word := range d.keywords {
+		d.keywords[word] *= d.Decay
+		if d.keywords[word] < minContextWeight {
+			delete(d.keywords, word)
+		}
+	}
+	for _, word := range keywords {
+		d.keywords[word] = 1
+	}
+	if topic != nil {
+		d.topic = append([]float64{}, topic...)
+	}
+	for _, sentence := range splitSentences(answer) {
+		d.answered[sentence] = true
+	}
+}
+
+// Смесь тем вопроса с затухающей темой прошлых вопросов
+func (d *Dialogue) blendTopic(topic []float64) []float64 {
+	if d.topic == nil {
+		return topic
+	}
+	if topic == nil || len(topic) != len(d.topic) {
+		return append([]float64{}, d.topic...)
+	}
+
+	blended := make([]float64, len(topic))
+	total := 0.0
+	for k := range topic {
+		blended[k] = topic[k] + d.Decay*d.topic[k]
+		total += blended[k]
+	}
+	for k := range blended {
+		blended[k] /= total
+	}
+	return blended
+}
+
+// Отвечали ли уже каким-нибудь из предложений текста
+func (d *Dialogue) repeats(text string) bool {
+	if d == nil {
+		return false
+	}
+	for _, sentence := range splitSentences(text) {
+		if d.answered[sentence] {
+			return true
+		}
+	}
+	return false
+}
+
+// Предложения текста в нижнем регистре без завершающих знаков
+func splitSentences(text string) []string {
+	var sentences []string
+	for _, sentence := range sentenceBoundary.Split(strings.TrimSpace(text), -1) {
+		sentence = strings.ToLower(strings.TrimRight(sentence, ".!?… "))
+		if sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+	}
+	return sentences
+}
+
+// Ключевые слова вопроса, известные модели
+func (g *AnswerGenerator) knownKeywords(keywords []string) []string {
+	var known []string
+	for _, keyword := range keywords {
+		if _, exists := g.chain.Vocab[keyword]; exists {
+			known = append(known, keyword)
+		}
+	}
+	return known
+}
+
+// Уточняющий вопрос без известных модели ключевых слов («а почему?»,
+// «расскажи подробнее») получает ключевые слова из контекста диалога
+func (g *AnswerGenerator) resolveFollowUp(keywords []string) []string {
+	dialogue := g.current.dialogue
+	if len(g.knownKeywords(keywords)) > 0 || len(dialogue.keywords) == 0 {
+		return keywords
+	}
+
+	context := dialogue.Keywords()
+	context = context[:min(contextKeywords, len(context))]
+	fmt.Printf("Follow-up question, using context keywords: %v\n", context)
+	return normalizeWords(append(append([]string{}, context...), keywords...))
+}
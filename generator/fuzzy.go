@@ -0,0 +1,141 @@
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"markmach/retrieval"
+)
+
+// Исправление слова вопроса
+type Correction struct {
+	From string // Слово, как оно было в вопросе
+	To   string // Слово словаря, которым оно заменено
+}
+
+// Сколько правок допускать при исправлении слова: короткие слова не
+// исправляются, иначе почти любое из них похоже на другое
+func maxEdits(word string) int {
+	switch length := utf8.RuneCountInString(word); {
+	case length <= 3:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Известно ли слово модели или это служебное слово вопроса
+func (g *AnswerGenerator) isKnownWord(word string) bool {
+	if stopWords[word] {
+		return true
+	}
+	_, exists := g.chain.Vocab[word]
+	return exists
+}
+
+// Исправляем слова, набранные не в той раскладке: слово вопроса заменяется,
+// если его не знает модель, а все слова в другой раскладке ей известны
+func (g *AnswerGenerator) fixLayout(question string) (string, []Correction) {
+	var corrections []Correction
+	fields := strings.Fields(question)
+	for i, field := range fields {
+		if g.allKnown(field) {
+			continue
+		}
+		switched := retrieval.SwitchLayout(field)
+		if switched != field && g.allKnown(switched) {
+			fields[i] = switched
+			corrections = append(corrections, Correction{From: field, To: switched})
+		}
+	}
+	if len(corrections) == 0 {
+		return question, nil
+	}
+	return strings.Join(fields, " "), corrections
+}
+
+// Все ли слова фрагмента известны; фрагмент без слов неизвестен
+func (g *AnswerGenerator) allKnown(text string) bool {
+	words := 0
+	for _, token := range g.tokenizer.Tokenize(text) {
+		if token == "<start>" || token == "<end>" || isPunctuation(token) {
+			continue
+		}
+		if !g.isKnownWord(token) {
+			return false
+		}
+		words++
+	}
+	return words > 0
+}
+
+// Заменяем неизвестные модели ключевые слова ближайшими словами словаря
+// по расстоянию редактирования; при равенстве берется более частое
+func (g *AnswerGenerator) correctKeywords(keywords []string) ([]string, []Correction) {
+	var corrections []Correction
+	corrected := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		corrected[i] = keyword
+		if g.isKnownWord(keyword) {
+			continue
+		}
+		if word := g.closestWord(keyword); word != "" {
+			corrected[i] = word
+			corrections = append(corrections, Correction{From: keyword, To: word})
+		}
+	}
+	return corrected, corrections
+}
+
+// Ближайшее слово словаря модели или "", если близких нет
+func (g *AnswerGenerator) closestWord(word string) string {
+	edits := maxEdits(word)
+	if edits == 0 {
+		return ""
+	}
+
+	matches := g.vocabularyTree().Search(word, edits)
+	if len(matches) == 0 {
+		return ""
+	}
+	best := matches[0]
+	for _, match := range matches[1:] {
+		if match.Distance == best.Distance && g.chain.Vocab[match.Word] > g.chain.Vocab[best.Word] {
+			best = match
+		}
+	}
+	return best.Word
+}
+
+// BK-дерево словаря модели; строится при первом исправлении
+func (g *AnswerGenerator) vocabularyTree() *retrieval.BKTree {
+	if g.vocabulary != nil {
+		return g.vocabulary
+	}
+
+	var words []string
+	for word := range g.chain.Vocab {
+		if word != "<start>" && word != "<end>" && !isPunctuation(word) {
+			words = append(words, word)
+		}
+	}
+	sort.Strings(words)
+	g.vocabulary = retrieval.NewBKTree(words)
+	return g.vocabulary
+}
+
+// Подсказка «возможно, вы имели в виду» по исправлениям вопроса
+func DidYouMean(corrections []Correction) string {
+	if len(corrections) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(corrections))
+	for i, correction := range corrections {
+		pairs[i] = fmt.Sprintf("%s → %s", correction.From, correction.To)
+	}
+	return "Возможно, вы имели в виду: " + strings.Join(pairs, ", ")
+}
@@ -0,0 +1,48 @@
+package generator
+
+import (
+	"testing"
+
+	"markmach/trainer"
+)
+
+// Слова в другой раскладке и опечатки исправляются, исправления попадают в ответ
+func TestQuestionCorrections(t *testing.T) {
+	g := testGenerator(testChain(t, trainer.TrainConfig{Order: 3}), 1)
+	answer, err := g.Generate(Request{Question: "что такое wtgm vfhrjdf и вероятнось"})
+	if err != nil {
+		t.Fatalf("generation failed: %v", err)
+	}
+
+	expected := []Correction{{"wtgm", "цепь"}, {"vfhrjdf", "маркова"}, {"вероятнось", "вероятность"}}
+	if len(answer.Corrections) != len(expected) {
+		t.Fatalf("corrections %v, expected %v", answer.Corrections, expected)
+	}
+	for i, correction := range expected {
+		if answer.Corrections[i] != correction {
+			t.Fatalf("corrections %v, expected %v", answer.Corrections, expected)
+		}
+	}
+}
+
+// Известные слова и короткие незнакомые слова не исправляются
+func TestKnownWordsAreKept(t *testing.T) {
+	g := testGenerator(testChain(t, trainer.TrainConfig{Order: 3}), 1)
+	if _, corrections := g.fixLayout("цепь маркова"); corrections != nil {
+		t.Fatalf("known words were switched: %v", corrections)
+	}
+	if _, corrections := g.correctKeywords([]string{"модель", "абв"}); corrections != nil {
+		t.Fatalf("known or short words were corrected: %v", corrections)
+	}
+}
+
+// Подсказка перечисляет исправления по порядку
+func TestDidYouMean(t *testing.T) {
+	if hint := DidYouMean(nil); hint != "" {
+		t.Fatalf("hint without corrections: %q", hint)
+	}
+	hint := DidYouMean([]Correction{{"ghbdtn", "привет"}, {"вероятнось", "вероятность"}})
+	if expected := "Возможно, вы имели в виду: ghbdtn → привет, вероятнось → вероятность"; hint != expected {
+		t.Fatalf("hint %q, expected %q", hint, expected)
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"markmach/retrieval"
 	"markmach/tokenizer"
 	"markmach/trainer"
 )
@@ -23,6 +25,33 @@ type AnswerGenerator struct {
 	tokenEntropy map[string]float64
 	minEntropy   float64
 	maxEntropy   float64
+	topic        []float64         // Смесь тем текущего вопроса
+	rng          *rand.Rand        // Собственный генератор случайных чисел
+	memoryDecay  float64           // Затухание контекста диалога в интерактивном режиме
+	vocabulary   *retrieval.BKTree // Словарь модели для исправления опечаток
+	defaults     settings          // Настройки запроса по умолчанию
+	current      settings          // Настройки текущего запроса
+}
+
+// Настройки, которые можно менять в каждом запросе
+type settings struct {
+	sampling    Sampling
+	decoding    Decoding
+	constraints Constraints
+	banned      map[string]bool // Запрещенные слова для быстрой проверки
+	repetition  Repetition
+	novelty     NoveltyGuard
+	length      AnswerLength
+	dialogue    *Dialogue // Контекст диалога (nil — вопрос сам по себе)
+}
+
+// Задаем ограничения запроса
+func (s *settings) setConstraints(constraints Constraints) {
+	s.constraints = constraints.normalized()
+	s.banned = make(map[string]bool)
+	for _, word := range s.constraints.Banned {
+		s.banned[word] = true
+	}
 }
 
 // Настройки генератора
@@ -30,6 +59,34 @@ type Config struct {
 	MaxLength          int
 	UsePunctuation     bool
 	MaxThematicEntropy float64
+	Seed               int64        // Зерно генератора: одинаковые модель, зерно и вопрос дают одинаковый ответ
+	Sampling           Sampling     // Настройки выбора следующего токена
+	Decoding           Decoding     // Поиск ответа: блуждание, N лучших или лучевой поиск
+	Constraints        Constraints  // Обязательные и запрещенные слова
+	Repetition         Repetition   // Штрафы за повторы и обнаружение циклов
+	Novelty            NoveltyGuard // Защита от дословного копирования корпуса
+	Length             AnswerLength // Целевая длина ответа в предложениях или символах
+	MemoryDecay        float64      // Затухание контекста диалога в интерактивном режиме (0 — без памяти)
+}
+
+// Запрос к генератору
+type Request struct {
+	Question    string
+	Sampling    *Sampling     // Настройки сэмплирования для этого запроса (nil — из Config)
+	Decoding    *Decoding     // Настройки поиска ответа для этого запроса (nil — из Config)
+	Constraints *Constraints  // Ограничения для этого запроса (nil — из Config)
+	Repetition  *Repetition   // Борьба с повторами для этого запроса (nil — из Config)
+	Novelty     *NoveltyGuard // Защита от копирования для этого запроса (nil — из Config)
+	Length      *AnswerLength // Целевая длина ответа для этого запроса (nil — из Config)
+	Dialogue    *Dialogue     // Контекст диалога, который запрос учитывает и дополняет (nil — без контекста)
+}
+
+// Ответ генератора
+type Answer struct {
+	Text        string
+	Score       Score        // Оценка выбранного кандидата
+	Candidates  int          // Сколько кандидатов сравнивалось
+	Corrections []Correction // Исправленные опечатки и раскладка слов вопроса
 }
 
 func NewAnswerGenerator(chain *trainer.MarkovChain, config Config) *AnswerGenerator {
@@ -45,81 +102,40 @@ func NewAnswerGenerator(chain *trainer.MarkovChain, config Config) *AnswerGenera
 		tokenEntropy: make(map[string]float64),
 		minEntropy:   math.MaxFloat64,
 		maxEntropy:   -math.MaxFloat64,
-	}
-	generator.analyzeEntropy()
+		rng:          rand.New(rand.NewSource(config.Seed)),
+		memoryDecay:  config.MemoryDecay,
+		defaults: settings{
+			sampling:   config.Sampling,
+			decoding:   config.Decoding.withDefaults(),
+			repetition: config.Repetition,
+			novelty:    config.Novelty,
+			length:     config.Length,
+		},
+	}
+	generator.defaults.setConstraints(config.Constraints)
+	generator.loadStats()
 
 	return generator
 }
 
-// Анализируем энтропию токенов в цепи Маркова
-func (g *AnswerGenerator) analyzeEntropy() {
-	fmt.Printf("Analyzing entropy for %d tokens...\n", len(g.chain.Vocab))
-
-	tokenContexts := make(map[string]map[string]int)
-	for prefix, suffixes := range g.chain.Chain {
-		prefixTokens := g.parsePrefix(prefix)
-
-		for _, token := range prefixTokens {
-			g.addTokenContext(token, prefixTokens, tokenContexts)
-		}
-
-		for suffix := range suffixes {
-			g.addTokenContext(suffix, prefixTokens, tokenContexts)
-		}
-	}
-
-	for token, contexts := range tokenContexts {
-		entropy := g.calculateEntropy(contexts)
-		g.tokenEntropy[token] = entropy
-
-		if entropy < g.minEntropy {
-			g.minEntropy = entropy
-		}
-		if entropy > g.maxEntropy {
-			g.maxEntropy = entropy
-		}
-	}
-
-	fmt.Printf("Entropy analysis complete. Range: [%.3f, %.3f]\n", g.minEntropy, g.maxEntropy)
-	g.printTopThematicTokens(15)
-}
-
-// Добавляем контекст для токена
-func (g *AnswerGenerator) addTokenContext(token string, context []string, tokenContexts map[string]map[string]int) {
-	if tokenContexts[token] == nil {
-		tokenContexts[token] = make(map[string]int)
+// Берем энтропию токенов из статистики модели; для старых моделей
+// без сохраненной статистики считаем ее при запуске
+func (g *AnswerGenerator) loadStats() {
+	stats := g.chain.Stats
+	if stats == nil {
+		fmt.Println("Model has no stored token statistics, computing them (run recompute-stats to store them)")
+		stats = g.chain.ComputeStats()
 	}
 
-	contextKey := g.createContextKey(context)
-	tokenContexts[token][contextKey]++
-}
-
-// Создаем ключ для контекста
-func (g *AnswerGenerator) createContextKey(tokens []string) string {
-	sorted := make([]string, len(tokens))
-	copy(sorted, tokens)
-	sort.Strings(sorted)
-	return strings.Join(sorted, "|")
-}
-
-// Вычисляем энтропию Шеннона для токена
-func (g *AnswerGenerator) calculateEntropy(contexts map[string]int) float64 {
-	total := 0
-	for _, count := range contexts {
-		total += count
+	for token, tokenStats := range stats.Tokens {
+		g.tokenEntropy[token] = tokenStats.Entropy
 	}
-
-	if total == 0 {
-		return math.MaxFloat64
-	}
-
-	entropy := 0.0
-	for _, count := range contexts {
-		probability := float64(count) / float64(total)
-		entropy -= probability * math.Log2(probability)
+	if len(stats.Tokens) > 0 {
+		g.minEntropy = stats.MinEntropy
+		g.maxEntropy = stats.MaxEntropy
 	}
 
-	return entropy
+	fmt.Printf("Token statistics: %d tokens, entropy range [%.3f, %.3f]\n", len(stats.Tokens), g.minEntropy, g.maxEntropy)
 }
 
 // Проверяем, является ли токен тематическим
@@ -143,29 +159,6 @@ func (g *AnswerGenerator) getThematicKeywords(keywords []string) []string {
 	return thematic
 }
 
-// Печатаем топ тематических токенов
-func (g *AnswerGenerator) printTopThematicTokens(limit int) {
-	type tokenEntropy struct {
-		token   string
-		entropy float64
-	}
-
-	var tokens []tokenEntropy
-	for token, entropy := range g.tokenEntropy {
-		tokens = append(tokens, tokenEntropy{token, entropy})
-	}
-
-	sort.Slice(tokens, func(i, j int) bool {
-		return tokens[i].entropy < tokens[j].entropy
-	})
-
-	fmt.Printf("\n=== Top %d Thematic Tokens ===\n", limit)
-	for i := 0; i < min(limit, len(tokens)); i++ {
-		fmt.Printf("%d. %s (entropy: %.3f)\n", i+1, tokens[i].token, tokens[i].entropy)
-	}
-	fmt.Println()
-}
-
 // Разбираем строковый префикс обратно в токены
 func (g *AnswerGenerator) parsePrefix(prefix string) []string {
 	cleaned := strings.TrimPrefix(prefix, "[")
@@ -189,28 +182,239 @@ func (g *AnswerGenerator) parsePrefix(prefix string) []string {
 
 // Генерируем ответ на вопрос пользователя
 func (g *AnswerGenerator) GenerateAnswer(question string) string {
-	keywords := g.extractKeywords(question)
+	answer, err := g.Generate(Request{Question: question})
+	if err != nil {
+		return fmt.Sprintf("Не удалось составить ответ: %v.", err)
+	}
+	return answer.Text
+}
 
-	if len(keywords) == 0 {
-		return "Пожалуйста, задайте вопрос."
+// Генерируем ответ на запрос со своими настройками
+func (g *AnswerGenerator) Generate(request Request) (Answer, error) {
+	g.current = g.defaults
+	if request.Sampling != nil {
+		if err := request.Sampling.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid sampling: %w", err)
+		}
+		g.current.sampling = *request.Sampling
+	}
+	if request.Decoding != nil {
+		if err := request.Decoding.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid decoding: %w", err)
+		}
+		g.current.decoding = request.Decoding.withDefaults()
+	}
+	if request.Constraints != nil {
+		if err := request.Constraints.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid constraints: %w", err)
+		}
+		g.current.setConstraints(*request.Constraints)
+	}
+	if request.Repetition != nil {
+		if err := request.Repetition.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid repetition settings: %w", err)
+		}
+		g.current.repetition = *request.Repetition
+	}
+	if request.Novelty != nil {
+		if err := request.Novelty.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid novelty guard: %w", err)
+		}
+		g.current.novelty = *request.Novelty
+	}
+	if request.Length != nil {
+		if err := request.Length.Validate(); err != nil {
+			return Answer{}, fmt.Errorf("invalid answer length: %w", err)
+		}
+		g.current.length = *request.Length
+	}
+	if err := g.current.novelty.Check(g.chain); err != nil {
+		return Answer{}, err
+	}
+	g.current.dialogue = request.Dialogue
+
+	return g.answer(request.Question)
+}
+
+// Ответ на вопрос с текущими настройками запроса. Слова не в той раскладке
+// и опечатки в ключевых словах исправляются по словарю модели. В диалоге
+// уточняющий вопрос дополняется ключевыми словами контекста, а ход запоминается
+func (g *AnswerGenerator) answer(question string) (Answer, error) {
+	question, corrections := g.fixLayout(question)
+	keywords, typos := g.correctKeywords(g.extractKeywords(question))
+	corrections = append(corrections, typos...)
+	dialogue := g.current.dialogue
+	if dialogue != nil {
+		keywords = g.resolveFollowUp(keywords)
+	}
+
+	answer, err := g.answerKeywords(keywords)
+	answer.Corrections = corrections
+	if dialogue != nil && err == nil && answer.Candidates > 0 {
+		dialogue.remember(g.knownKeywords(keywords), g.topic, answer.Text)
+	}
+	return answer, err
+}
+
+// Ответ по ключевым словам. При ограничениях, защите от копирования или
+// повторе прошлых ответов диалога кандидаты, не прошедшие проверку,
+// отбрасываются, и генерация повторяется
+func (g *AnswerGenerator) answerKeywords(keywords []string) (Answer, error) {
+	constraints := g.current.constraints
+	dialogue := g.current.dialogue
+
+	if len(keywords) == 0 && len(constraints.Required) == 0 {
+		return Answer{Text: "Пожалуйста, задайте вопрос."}, nil
+	}
+	if unknown := g.unknownRequired(); len(unknown) > 0 {
+		return Answer{}, fmt.Errorf("%w: required words %v are not in the model vocabulary", ErrConstraintsUnsatisfied, unknown)
 	}
 
+	g.inferQuestionTopic(keywords)
+
 	thematicKeywords := g.getThematicKeywords(keywords)
 	searchKeywords := keywords
 	if len(thematicKeywords) > 0 {
 		searchKeywords = thematicKeywords
 		fmt.Printf("Using thematic keywords: %v\n", thematicKeywords)
 	}
+	searchKeywords = normalizeWords(append(append([]string{}, searchKeywords...), constraints.Required...))
+
+	if constraints.empty() && !g.current.novelty.enabled() && (dialogue == nil || len(dialogue.answered) == 0) {
+		candidates := g.generateCandidates(searchKeywords)
+		if len(candidates) == 0 {
+			return Answer{Text: "К сожалению, я не нашел информации по вашему вопросу в изученном материале."}, nil
+		}
+		return g.composeAnswer(g.rerank(candidates, keywords), keywords), nil
+	}
+
+	generated, copied := 0, 0
+	var repeated []string
+	for attempt := 0; attempt <= constraints.MaxRetries; attempt++ {
+		var satisfying []string
+		candidates := g.generateCandidates(searchKeywords)
+		for _, candidate := range candidates {
+			if !g.satisfiesConstraints(candidate) {
+				continue
+			}
+			if !g.isNovel(candidate) {
+				copied++
+				continue
+			}
+			if dialogue.repeats(g.formatAnswer(candidate)) {
+				repeated = append(repeated, candidate)
+				continue
+			}
+			satisfying = append(satisfying, candidate)
+		}
+		generated += len(candidates)
+
+		if len(satisfying) > 0 {
+			if attempt > 0 {
+				fmt.Printf("Answer accepted after %d retries\n", attempt)
+			}
+			return g.composeAnswer(g.rerank(satisfying, keywords), keywords), nil
+		}
+	}
 
-	relevantSentences := g.chain.Search(searchKeywords, 5)
+	if generated == 0 && constraints.empty() {
+		return Answer{Text: "К сожалению, я не нашел информации по вашему вопросу в изученном материале."}, nil
+	}
+	// Лучше повторить прошлый ответ, чем не ответить вовсе
+	if len(repeated) > 0 {
+		fmt.Println("Only answers given earlier were found")
+		return g.composeAnswer(g.rerank(repeated, keywords), keywords), nil
+	}
+	if copied > 0 {
+		return Answer{}, fmt.Errorf("%w: %d of %d candidates in %d attempts contain %d tokens in a row from the corpus",
+			ErrNotNovel, copied, generated, constraints.MaxRetries+1, g.chain.Ngrams.N)
+	}
+	return Answer{}, fmt.Errorf("%w: none of %d candidates in %d attempts contains all of %v without %v",
+		ErrConstraintsUnsatisfied, generated, constraints.MaxRetries+1, constraints.Required, constraints.Banned)
+}
+
+// Один ответ случайным блужданием: вокруг ключевого слова, если есть
+// обратная цепь, иначе продолжением самого релевантного предложения
+func (g *AnswerGenerator) sampleAnswer(keywords []string) string {
+	if g.chain.Backward != nil {
+		if keyword := g.anchorKeyword(keywords); keyword != "" {
+			if answer := g.generateAroundKeyword(keyword, keywords); answer != "" {
+				return answer
+			}
+		}
+	}
+
+	bestSentence := g.relevantSentence(keywords)
+	if bestSentence == "" {
+		return ""
+	}
+	return g.generateFromSentence(bestSentence, keywords)
+}
+
+// Самое релевантное вопросу предложение корпуса. При ограничениях
+// берется случайное из предложений, которые им удовлетворяют, чтобы
+// повторные попытки начинались с разных предложений
+func (g *AnswerGenerator) relevantSentence(keywords []string) string {
+	if constraints := g.current.constraints; !constraints.empty() {
+		var suitable []string
+		for _, sentence := range g.chain.SearchTopic(keywords, g.topic, constrainedSearchLimit) {
+			if g.satisfiesConstraints(sentence) {
+				suitable = append(suitable, sentence)
+			}
+		}
+		if len(suitable) == 0 {
+			return ""
+		}
+		return suitable[g.rng.Intn(len(suitable))]
+	}
+
+	relevantSentences := g.chain.SearchTopic(keywords, g.topic, 5)
 	if len(relevantSentences) == 0 {
-		return "К сожалению, я не нашел информации по вашему вопросу в изученном материале."
+		return ""
 	}
+	// В диалоге начинаем с предложений, которыми еще не отвечали
+	var fresh []string
+	for _, sentence := range relevantSentences {
+		if !g.current.dialogue.repeats(sentence) {
+			fresh = append(fresh, sentence)
+		}
+	}
+	if len(fresh) > 0 {
+		relevantSentences = fresh
+	}
+	return g.findBestSentence(relevantSentences, keywords)
+}
 
-	bestSentence := g.findBestSentence(relevantSentences, searchKeywords)
-	answer := g.generateFromSentence(bestSentence, searchKeywords)
+// Определяем тему вопроса по тематической модели, если она есть в модели
+func (g *AnswerGenerator) inferQuestionTopic(keywords []string) {
+	g.topic = nil
+	if g.chain.TopicModel == nil {
+		return
+	}
 
-	return g.formatAnswer(answer)
+	for _, keyword := range keywords {
+		if _, exists := g.chain.TopicModel.Words[keyword]; exists {
+			g.topic = g.chain.TopicModel.Infer(keywords)
+			break
+		}
+	}
+	if g.current.dialogue != nil {
+		g.topic = g.current.dialogue.blendTopic(g.topic)
+	}
+	if g.topic == nil {
+		return
+	}
+
+	topic, share := trainer.DominantTopic(g.topic)
+	fmt.Printf("Question topic: %d (%.2f) %v\n", topic, share, g.chain.Topics[strconv.Itoa(topic)])
+}
+
+// Близость токена к теме вопроса: 0, если тема не определена
+func (g *AnswerGenerator) topicAffinity(token string) float64 {
+	if g.topic == nil {
+		return 0
+	}
+	return g.chain.TopicModel.Affinity(token, g.topic)
 }
 
 // Учет тематики
@@ -276,29 +480,31 @@ func (g *AnswerGenerator) findThematicStartPosition(tokens []string, keywords []
 func (g *AnswerGenerator) generateThematicContinuation(tokens []string, startPos int, keywords []string) string {
 	var result []string
 
-	if startPos > 0 {
-		result = append(result, tokens[:startPos]...)
+	if from := g.copiedPrefixStart(startPos); startPos > from {
+		result = append(result, tokens[from:startPos]...)
 	}
 
 	currentPos := startPos
 	attempts := 0
 	maxAttempts := 10
+	ended := false // Цепь сама завершила предложение или остановилась на цикле
 
 	for len(result) < g.maxLength && currentPos < len(tokens) && attempts < maxAttempts {
-		var currentPrefix []string
-		if len(result) >= g.chain.Order-1 {
-			currentPrefix = result[len(result)-g.chain.Order+1:]
-		} else {
-			needed := g.chain.Order - 1 - len(result)
-			startIdx := max(0, currentPos-needed)
-			currentPrefix = append(tokens[startIdx:currentPos], result...)
+		if len(result) < g.chain.Order-1 {
+			result = append(result, tokens[currentPos])
+			currentPos++
+			continue
 		}
+		weights, stop := g.nextWeights(g.chain, result, keywords)
+		if stop {
+			ended = true
+			break
+		}
+		if len(weights) > 0 {
+			nextToken := g.selectNextToken(weights)
 
-		nextTokens := g.chain.GetNextTokens(currentPrefix)
-		if nextTokens != nil && len(nextTokens) > 0 {
-			nextToken := g.selectThematicToken(nextTokens, keywords)
-
-			if nextToken == "<end>" {
+			if nextToken == "<end>" || nextToken == "" {
+				ended = true
 				break
 			}
 
@@ -313,7 +519,10 @@ func (g *AnswerGenerator) generateThematicContinuation(tokens []string, startPos
 		}
 	}
 
-	if len(result) < g.maxLength/2 && currentPos < len(tokens) {
+	// Хвост исходного предложения добавляем, только если цепь не закончила
+	// предложение сама, иначе ответ повторяет уже сгенерированный текст.
+	// При защите от копирования хвост не добавляется вовсе
+	if !ended && !g.current.novelty.enabled() && len(result) < g.maxLength/2 && currentPos < len(tokens) {
 		remaining := min(g.maxLength-len(result), len(tokens)-currentPos)
 		result = append(result, tokens[currentPos:currentPos+remaining]...)
 	}
@@ -321,13 +530,157 @@ func (g *AnswerGenerator) generateThematicContinuation(tokens []string, startPos
 	return g.tokenizer.JoinTokens(result)
 }
 
-// Выбираем следующий токен с учетом тематики
-func (g *AnswerGenerator) selectThematicToken(probabilities map[string]float64, keywords []string) string {
-	weightedProbabilities := make(map[string]float64)
+// Опорное слово ответа: случайное из обязательных, чтобы повторные попытки
+// пробовали разные, иначе самое тематическое из ключевых
+func (g *AnswerGenerator) anchorKeyword(keywords []string) string {
+	if required := g.current.constraints.Required; len(required) > 0 {
+		return required[g.rng.Intn(len(required))]
+	}
+	return g.pickAnchorKeyword(keywords)
+}
+
+// Выбираем самое тематическое ключевое слово, известное цепи: с наименьшей
+// энтропией, с поправкой на близость к теме вопроса
+func (g *AnswerGenerator) pickAnchorKeyword(keywords []string) string {
+	anchor := ""
+	bestScore := 0.0
+	for _, keyword := range keywords {
+		if _, exists := g.chain.Vocab[keyword]; !exists {
+			continue
+		}
+
+		score := 0.0
+		if entropy, exists := g.tokenEntropy[keyword]; exists {
+			score = (1 + g.topicAffinity(keyword)) / (entropy + 0.1)
+		}
+		if anchor == "" || score > bestScore {
+			anchor = keyword
+			bestScore = score
+		}
+	}
+	return anchor
+}
+
+// Выращиваем предложение от ключевого слова: вправо по прямой цепи до <end>,
+// влево по обратной цепи до начала предложения
+func (g *AnswerGenerator) generateAroundKeyword(keyword string, keywords []string) string {
+	result := g.findKeywordWindow(keyword)
+	if len(result) == 0 {
+		return ""
+	}
+
+	result = g.extendForward(result, keywords)
+	result = g.extendBackward(result, keywords)
+	return g.tokenizer.JoinTokens(result)
+}
+
+// Продолжаем токены по прямой цепи до <end> или предельной длины
+func (g *AnswerGenerator) extendForward(result []string, keywords []string) []string {
+	finished := result[len(result)-1] == "<end>"
+	for !finished && len(result) < g.maxLength {
+		weights, _ := g.nextWeights(g.chain, result, keywords)
+		if len(weights) == 0 {
+			break
+		}
+
+		nextToken := g.selectNextToken(weights)
+		if nextToken == "<end>" || nextToken == "" {
+			break
+		}
+		result = append(result, nextToken)
+	}
+	return result
+}
+
+// Достраиваем начало токенов по обратной цепи. В обратной цепи <end>
+// означает начало исходного предложения
+func (g *AnswerGenerator) extendBackward(result []string, keywords []string) []string {
+	started := result[0] == "<start>"
+	for !started && len(result) < g.maxLength {
+		weights, _ := g.nextWeights(g.chain.Backward, trainer.ReverseSentence(result), keywords)
+		if len(weights) == 0 {
+			break
+		}
+
+		prevToken := g.selectNextToken(weights)
+		if prevToken == "<end>" || prevToken == "" {
+			break
+		}
+		result = append([]string{prevToken}, result...)
+	}
+	return result
+}
+
+// Случайное окно из Order токенов цепи, содержащее ключевое слово;
+// окна выбираются пропорционально частоте перехода
+func (g *AnswerGenerator) findKeywordWindow(keyword string) []string {
+	var windows [][]string
+	var weights []float64
 	totalWeight := 0.0
 
+	for prefix, suffixes := range g.chain.Chain {
+		prefixTokens := g.parsePrefix(prefix)
+		if len(prefixTokens) != g.chain.Order-1 {
+			continue
+		}
+
+		inPrefix := false
+		for _, token := range prefixTokens {
+			if token == keyword {
+				inPrefix = true
+				break
+			}
+		}
+
+		if g.containsBanned(prefixTokens) {
+			continue
+		}
+
+		for suffix, count := range suffixes {
+			if !inPrefix && suffix != keyword {
+				continue
+			}
+			if g.isBanned(suffix) {
+				continue
+			}
+			window := append(append([]string{}, prefixTokens...), suffix)
+			windows = append(windows, window)
+			weights = append(weights, float64(count))
+			totalWeight += float64(count)
+		}
+	}
+	if len(windows) == 0 {
+		return nil
+	}
+
+	// Сортируем окна, чтобы выбор зависел только от случайного числа
+	order := make([]int, len(windows))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return strings.Join(windows[order[i]], " ") < strings.Join(windows[order[j]], " ")
+	})
+
+	r := g.rng.Float64() * totalWeight
+	for _, i := range order {
+		r -= weights[i]
+		if r <= 0 {
+			return windows[i]
+		}
+	}
+	return windows[order[len(order)-1]]
+}
+
+// Веса продолжений: вероятности, усиленные для ключевых слов и слов темы вопроса
+func (g *AnswerGenerator) thematicWeights(probabilities map[string]float64, keywords []string) map[string]float64 {
+	weightedProbabilities := make(map[string]float64)
+
 	for token, prob := range probabilities {
-		weight := prob
+		if g.isBanned(token) {
+			continue
+		}
+		weight := prob * (1 + g.topicAffinity(token))
 
 		for _, keyword := range keywords {
 			if token == keyword {
@@ -342,16 +695,19 @@ func (g *AnswerGenerator) selectThematicToken(probabilities map[string]float64,
 		}
 
 		weightedProbabilities[token] = weight
-		totalWeight += weight
 	}
 
-	if totalWeight > 0 {
-		for token := range weightedProbabilities {
-			weightedProbabilities[token] /= totalWeight
-		}
-	}
+	return weightedProbabilities
+}
 
-	return g.selectNextToken(weightedProbabilities)
+// Служебные слова вопроса, которые не считаются ключевыми
+var stopWords = map[string]bool{
+	"что": true, "как": true, "зачем": true, "почему": true,
+	"где": true, "когда": true, "какой": true, "какая": true,
+	"какое": true, "какие": true, "объясни": true, "расскажи": true,
+	"пожалуйста": true, "мог": true, "бы": true, "ли": true,
+	"такое": true, "подробнее": true, "еще": true, "ещё": true,
+	"<start>": true, "<end>": true,
 }
 
 // Извлекаем ключевые слова из вопроса
@@ -359,16 +715,8 @@ func (g *AnswerGenerator) extractKeywords(question string) []string {
 	tokens := g.tokenizer.Tokenize(question)
 
 	var keywords []string
-	stopWords := map[string]bool{
-		"что": true, "как": true, "зачем": true, "почему": true,
-		"где": true, "когда": true, "какой": true, "какая": true,
-		"какое": true, "какие": true, "объясни": true, "расскажи": true,
-		"пожалуйста": true, "мог": true, "бы": true, "ли": true,
-		"<start>": true, "<end>": true,
-	}
-
 	for _, token := range tokens {
-		if !stopWords[token] && len(token) > 1 && !isPunctuation(token) {
+		if !stopWords[token] && utf8.RuneCountInString(token) > 1 && !isPunctuation(token) {
 			keywords = append(keywords, token)
 		}
 	}
@@ -407,28 +755,9 @@ func (g *AnswerGenerator) findBestSentence(sentences []string, keywords []string
 	return bestSentence
 }
 
-// Выбираем следующий токен на основе вероятностей
-func (g *AnswerGenerator) selectNextToken(probabilities map[string]float64) string {
-	rand.Seed(time.Now().UnixNano())
-	r := rand.Float64()
-
-	cumulative := 0.0
-	for token, prob := range probabilities {
-		cumulative += prob
-		if r <= cumulative {
-			return token
-		}
-	}
-
-	var maxToken string
-	maxProb := 0.0
-	for token, prob := range probabilities {
-		if prob > maxProb {
-			maxProb = prob
-			maxToken = token
-		}
-	}
-	return maxToken
+// Выбираем следующий токен по настройкам сэмплирования текущего запроса
+func (g *AnswerGenerator) selectNextToken(weights map[string]float64) string {
+	return g.current.sampling.sample(weights, g.rng)
 }
 
 // Форматируем конечный ответ
@@ -460,6 +789,11 @@ func (g *AnswerGenerator) formatAnswer(answer string) string {
 func (g *AnswerGenerator) InteractiveMode() {
 	scanner := bufio.NewScanner(os.Stdin)
 
+	var dialogue *Dialogue
+	if g.memoryDecay > 0 {
+		dialogue, _ = NewDialogue(g.memoryDecay)
+	}
+
 	for {
 		fmt.Print("Вопрос: ")
 		if !scanner.Scan() {
@@ -477,9 +811,28 @@ func (g *AnswerGenerator) InteractiveMode() {
 			continue
 		}
 
+		if question == "сброс" || question == "reset" {
+			if dialogue != nil {
+				dialogue.Reset()
+			}
+			fmt.Println("Контекст диалога очищен.")
+			continue
+		}
+
 		fmt.Println("Обрабатываю вопрос...")
-		answer := g.GenerateAnswer(question)
-		fmt.Printf("Ответ: %s\n\n", answer)
+		answer, err := g.Generate(Request{Question: question, Dialogue: dialogue})
+		if err != nil {
+			fmt.Printf("Ошибка: %v\n\n", err)
+			continue
+		}
+		if hint := DidYouMean(answer.Corrections); hint != "" {
+			fmt.Println(hint)
+		}
+		if answer.Candidates > 0 {
+			fmt.Printf("Score: %.3f (log-prob %.3f over %d tokens, coverage %.2f, novelty %.2f, longest copy %d)\n",
+				answer.Score.Total, answer.Score.LogProb, answer.Score.Tokens, answer.Score.Coverage, answer.Score.Novelty, answer.Score.Copied)
+		}
+		fmt.Printf("Ответ: %s\n\n", answer.Text)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -0,0 +1,69 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+
+	"markmach/tokenizer"
+	"markmach/trainer"
+)
+
+// Корпус тестов генератора: короткие предложения о выборе слов и поиске
+// ответа. В нем есть повторяющиеся состояния («модель», запятая) и
+// N-граммы, по которым проверяется защита от копирования
+const testCorpus = `Цепь Маркова выбирает следующее слово по текущему состоянию.
+Вероятность перехода зависит только от текущего состояния, а не от истории.
+Языковая модель учитывает несколько предыдущих слов.
+Модель выбирает продолжение случайно, но с учетом частот.
+Модель хорошо отвечает на короткие вопросы.
+Поиск находит в корпусе предложения, похожие на вопрос.
+Генератор строит ответ вокруг ключевого слова вопроса.
+Ответ начинается с найденного предложения и продолжается по цепи.
+Температура, порог и лучевой поиск меняют выбор слов.
+Вероятность каждого ответа оценивается по модели, покрытию и новизне.`
+
+// Модель, обученная на тестовом корпусе
+func testChain(t *testing.T, config trainer.TrainConfig) *trainer.MarkovChain {
+	t.Helper()
+	config.Tokenizer = tokenizer.Config{KeepPunctuation: true, ToLowerCase: true}
+	tok := tokenizer.NewTokenizer(config.Tokenizer)
+	chain := trainer.NewMarkovTrainer(config)
+	if err := chain.Train(tok.TokenizeSentences(strings.Split(testCorpus, "\n"))); err != nil {
+		t.Fatalf("training failed: %v", err)
+	}
+	return chain
+}
+
+// Генератор с настройками чата по умолчанию
+func testGenerator(chain *trainer.MarkovChain, seed int64) *AnswerGenerator {
+	return NewAnswerGenerator(chain, Config{
+		MaxLength:      30,
+		UsePunctuation: true,
+		Seed:           seed,
+		Sampling:       Sampling{Temperature: 1, TopP: 1},
+		Repetition:     Repetition{NoRepeatNGram: 4, MaxStateVisits: 2},
+	})
+}
+
+// Одинаковые модель, зерно и вопросы дают одинаковые ответы
+func TestSameSeedSameAnswers(t *testing.T) {
+	questions := []string{"что такое языковая модель", "как работает поиск", "цепь маркова"}
+	for _, config := range []trainer.TrainConfig{{Order: 3}, {Order: 3, Backward: true}, {Order: 3, Backoff: trainer.BackoffKatz}} {
+		chain := testChain(t, config)
+		first, second := testGenerator(chain, 42), testGenerator(chain, 42)
+		for _, question := range questions {
+			a, b := first.GenerateAnswer(question), second.GenerateAnswer(question)
+			if a != b {
+				t.Fatalf("same seed gave different answers to %q: %q and %q", question, a, b)
+			}
+		}
+	}
+}
+
+// Ответ короче окна проверки не может быть скопирован и не штрафуется
+func TestShortAnswerIsNovel(t *testing.T) {
+	g := testGenerator(testChain(t, trainer.TrainConfig{Order: 3}), 1)
+	if novelty := g.novelty([]string{"<start>", "модель", "<end>"}); novelty != 1 {
+		t.Fatalf("novelty of a one-word answer is %g, expected 1", novelty)
+	}
+}
@@ -0,0 +1,105 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+
+	"markmach/trainer"
+)
+
+// Режимы защиты от дословного копирования корпуса
+const (
+	NoveltyReject   = "reject"   // Отбрасывать ответы со скопированными фрагментами и генерировать заново
+	NoveltyResample = "resample" // Не выбирать токены, завершающие N-грамму корпуса, и отбрасывать оставшиеся копии
+)
+
+// Ни один кандидат не прошел проверку на копирование корпуса
+var ErrNotNovel = errors.New("answer copies the corpus")
+
+// Защита от копирования. Длина N-грамм задается при обучении
+// (--novelty-ngram): ответ не должен содержать N токенов подряд из корпуса,
+// то есть копировать больше N-1 токенов подряд
+type NoveltyGuard struct {
+	Mode string // reject или resample ("" — без проверки)
+}
+
+// Проверка настроек защиты
+func (n NoveltyGuard) Validate() error {
+	switch n.Mode {
+	case "", NoveltyReject, NoveltyResample:
+		return nil
+	default:
+		return fmt.Errorf("unknown novelty guard mode %q (expected %q or %q)", n.Mode, NoveltyReject, NoveltyResample)
+	}
+}
+
+// Включена ли защита
+func (n NoveltyGuard) enabled() bool {
+	return n.Mode != ""
+}
+
+// Проверка, что модель подходит для защиты: нужен набор N-грамм корпуса
+func (n NoveltyGuard) Check(chain *trainer.MarkovChain) error {
+	if n.enabled() && chain.Ngrams == nil {
+		return fmt.Errorf("novelty guard needs a model trained with --novelty-ngram")
+	}
+	return nil
+}
+
+// Нет ли в тексте фрагментов, скопированных из корпуса. Без защиты — всегда да
+func (g *AnswerGenerator) isNovel(text string) bool {
+	if !g.current.novelty.enabled() {
+		return true
+	}
+	longest, _ := g.chain.Ngrams.Copied(g.tokenizer.Tokenize(text))
+	return longest == 0
+}
+
+// С какой позиции брать начало исходного предложения перед startPos,
+// чтобы вместе с Order-1 токенами старта не скопировать N токенов подряд
+func (g *AnswerGenerator) copiedPrefixStart(startPos int) int {
+	if !g.current.novelty.enabled() {
+		return 0
+	}
+	return max(0, startPos-(g.chain.Ngrams.N-g.chain.Order))
+}
+
+// В режиме resample убираем продолжения, которые вместе с последними N-1
+// словами истории дают N-грамму корпуса. История обратной цепи перевернута
+func (g *AnswerGenerator) blockCopies(weights map[string]float64, history []string, reversed bool) {
+	if g.current.novelty.Mode != NoveltyResample {
+		return
+	}
+
+	ngrams := g.chain.Ngrams
+	var tail []string
+	for i := len(history) - 1; i >= 0 && len(tail) < ngrams.N-1; i-- {
+		if history[i] != "<start>" && history[i] != "<end>" {
+			tail = append(tail, history[i])
+		}
+	}
+	if len(tail) < ngrams.N-1 {
+		return
+	}
+	// tail собран с конца истории. Для прямой цепи это обратный порядок
+	// текста, и токен идет после него; для обратной цепи — уже порядок
+	// текста, и токен стоит перед ним
+	if !reversed {
+		tail = trainer.ReverseSentence(tail)
+	}
+
+	for token := range weights {
+		if token == "<start>" || token == "<end>" {
+			continue
+		}
+		var ngram []string
+		if reversed {
+			ngram = append([]string{token}, tail...)
+		} else {
+			ngram = append(append([]string{}, tail...), token)
+		}
+		if ngrams.Contains(ngram) {
+			delete(weights, token)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package generator
+
+import (
+	"testing"
+
+	"markmach/trainer"
+)
+
+// Генератор с защитой от копирования в режиме resample
+func resampleGenerator(t *testing.T, backward bool) *AnswerGenerator {
+	t.Helper()
+	chain := testChain(t, trainer.TrainConfig{Order: 2, NoveltyNGram: 3, Backward: backward})
+	g := testGenerator(chain, 1)
+	g.current.novelty = NoveltyGuard{Mode: NoveltyResample}
+	return g
+}
+
+// Прямая цепь: продолжение, завершающее N-грамму корпуса, убирается
+func TestBlockCopiesForward(t *testing.T) {
+	g := resampleGenerator(t, false)
+	weights := map[string]float64{"только": 1, "от": 1}
+	g.blockCopies(weights, []string{"<start>", "<start>", "перехода", "зависит"}, false)
+	if _, exists := weights["только"]; exists {
+		t.Fatalf("copied continuation was not blocked: %v", weights)
+	}
+	if _, exists := weights["от"]; !exists {
+		t.Fatalf("novel continuation was blocked: %v", weights)
+	}
+}
+
+// Обратная цепь: история перевернута, токен стоит перед ней в тексте
+func TestBlockCopiesReversed(t *testing.T) {
+	g := resampleGenerator(t, true)
+	weights := map[string]float64{"перехода": 1, "модель": 1}
+	g.blockCopies(weights, []string{"<start>", "<start>", "только", "зависит"}, true)
+	if _, exists := weights["перехода"]; exists {
+		t.Fatalf("copied continuation was not blocked: %v", weights)
+	}
+	if _, exists := weights["модель"]; !exists {
+		t.Fatalf("novel continuation was blocked: %v", weights)
+	}
+}
+
+// Текст короче N-граммы не может быть скопирован
+func TestCopiedShortText(t *testing.T) {
+	set := trainer.NewNgramSet(3)
+	if longest, novelty := set.Copied([]string{"модель"}); longest != 0 || novelty != 1 {
+		t.Fatalf("short text: longest %d, novelty %g, expected 0 and 1", longest, novelty)
+	}
+}
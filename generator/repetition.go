@@ -0,0 +1,130 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+
+	"markmach/trainer"
+)
+
+// Настройки борьбы с повторами. Нулевое значение отключает все проверки
+type Repetition struct {
+	FrequencyPenalty float64 // Штраф за каждое прошлое появление слова: вес умножается на exp(-штраф * число)
+	PresencePenalty  float64 // Штраф за то, что слово уже встречалось: вес умножается на exp(-штраф)
+	NoRepeatNGram    int     // Запрещать повтор N-грамм этой длины (0 — не запрещать)
+	MaxStateVisits   int     // Сколько раз можно вернуться в одно состояние цепи, прежде чем избегать прежних продолжений (0 — без проверки)
+}
+
+// Проверка настроек повторов
+func (r Repetition) Validate() error {
+	if r.FrequencyPenalty < 0 || r.PresencePenalty < 0 {
+		return fmt.Errorf("repetition penalties must not be negative, got %g and %g", r.FrequencyPenalty, r.PresencePenalty)
+	}
+	if r.NoRepeatNGram < 0 {
+		return fmt.Errorf("no-repeat n-gram size must not be negative, got %d", r.NoRepeatNGram)
+	}
+	if r.MaxStateVisits < 0 {
+		return fmt.Errorf("maximum state visits must not be negative, got %d", r.MaxStateVisits)
+	}
+	return nil
+}
+
+// Веса следующего токена после истории с учетом тематики и повторов.
+// История идет в направлении цепи (для обратной цепи — перевернута).
+// Если состояние цепи повторяется чаще допустимого, из распределения
+// убираются уже выбранные в этом состоянии продолжения; цепь с откатом
+// берет для этого распределение более короткого контекста. Если других
+// продолжений нет — stop сообщает, что генерацию пора закончить. Состояния
+// из одних знаков препинания и служебных токенов не ограничиваются: запятая
+// встречается в предложении много раз и сама по себе не цикл
+func (g *AnswerGenerator) nextWeights(chain *trainer.MarkovChain, history []string, keywords []string) (weights map[string]float64, stop bool) {
+	repetition := g.current.repetition
+	context := history[max(0, len(history)-chain.Order+1):]
+
+	probabilities := chain.GetNextTokens(context)
+	if repetition.MaxStateVisits > 0 && hasWords(context) {
+		if visits, followers := stateVisits(history, len(context)); visits > repetition.MaxStateVisits {
+			if chain.IsVariableOrder() {
+				probabilities = chain.GetNextTokens(context[1:])
+			}
+			for token := range followers {
+				delete(probabilities, token)
+			}
+			if len(probabilities) == 0 {
+				return nil, true
+			}
+		}
+	}
+	if len(probabilities) == 0 {
+		return nil, false
+	}
+
+	weights = g.thematicWeights(probabilities, keywords)
+	g.penalizeRepeats(weights, history)
+	g.blockCopies(weights, history, chain != g.chain)
+	return weights, false
+}
+
+// Сколько раз история уже была в текущем состоянии (последние size токенов)
+// и какие токены следовали за ним раньше
+func stateVisits(history []string, size int) (int, map[string]bool) {
+	followers := make(map[string]bool)
+	if size == 0 {
+		return 0, followers
+	}
+
+	state := history[len(history)-size:]
+	visits := 0
+	for end := size; end <= len(history); end++ {
+		if !equalTokens(history[end-size:end], state) {
+			continue
+		}
+		visits++
+		if end < len(history) {
+			followers[history[end]] = true
+		}
+	}
+	return visits, followers
+}
+
+// Штрафы за частоту и присутствие и запрет повтора N-грамм. Служебные
+// токены и знаки препинания не штрафуются
+func (g *AnswerGenerator) penalizeRepeats(weights map[string]float64, history []string) {
+	repetition := g.current.repetition
+
+	if repetition.FrequencyPenalty > 0 || repetition.PresencePenalty > 0 {
+		counts := make(map[string]int)
+		for _, token := range history {
+			counts[token]++
+		}
+		for token := range weights {
+			count := counts[token]
+			if count == 0 || token == "<start>" || token == "<end>" || isPunctuation(token) {
+				continue
+			}
+			weights[token] *= math.Exp(-repetition.FrequencyPenalty*float64(count) - repetition.PresencePenalty)
+		}
+	}
+
+	if n := repetition.NoRepeatNGram; n > 0 && len(history) >= n-1 {
+		prefix := history[len(history)-n+1:]
+		for end := n - 1; end < len(history); end++ {
+			if equalTokens(history[end-n+1:end], prefix) {
+				delete(weights, history[end])
+			}
+		}
+	}
+}
+
+// Совпадают ли последовательности токенов
+func equalTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package generator
+
+import (
+	"testing"
+
+	"markmach/trainer"
+)
+
+// Цепь второго порядка без отката: после третьего возврата в состояние
+// прежние продолжения исключаются, а генерация не обрывается
+func TestStateVisitsAvoidEarlierFollowers(t *testing.T) {
+	chain := testChain(t, trainer.TrainConfig{Order: 2})
+	g := testGenerator(chain, 1)
+	g.current.repetition = Repetition{MaxStateVisits: 2}
+
+	history := []string{"<start>", "модель", "учитывает", "модель", "выбирает", "модель"}
+	weights, stop := g.nextWeights(chain, history, nil)
+	if stop || len(weights) == 0 {
+		t.Fatalf("generation stopped in a state with unused continuations")
+	}
+	for _, token := range []string{"учитывает", "выбирает"} {
+		if _, exists := weights[token]; exists {
+			t.Fatalf("earlier continuation %q was offered again: %v", token, weights)
+		}
+	}
+
+	// Запятые повторяются в предложении и не считаются циклом
+	history = []string{"<start>", "слово", ",", "слово", ",", "слово", ","}
+	if weights, stop := g.nextWeights(chain, history, nil); stop || len(weights) == 0 {
+		t.Fatalf("generation stopped after a repeated comma")
+	}
+}
@@ -0,0 +1,146 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Настройки выбора следующего токена. Нулевое значение — обычное
+// сэмплирование пропорционально вероятностям
+type Sampling struct {
+	Greedy      bool    // Всегда брать самый вероятный токен
+	Temperature float64 // Температура: меньше 1 — увереннее, больше 1 — разнообразнее (0 — без изменений)
+	TopK        int     // Оставлять только K самых вероятных токенов (0 — все)
+	TopP        float64 // Ядро: самые вероятные токены с суммарной вероятностью не меньше P (0 — все)
+	MinP        float64 // Отбрасывать токены с вероятностью меньше MinP от самой вероятной
+}
+
+// Кандидат на следующий токен
+type candidate struct {
+	token  string
+	weight float64
+}
+
+// Проверка настроек сэмплирования
+func (s Sampling) Validate() error {
+	if s.Temperature < 0 {
+		return fmt.Errorf("temperature must not be negative, got %g", s.Temperature)
+	}
+	if s.TopK < 0 {
+		return fmt.Errorf("top-k must not be negative, got %d", s.TopK)
+	}
+	if s.TopP < 0 || s.TopP > 1 {
+		return fmt.Errorf("top-p must be in [0, 1], got %g", s.TopP)
+	}
+	if s.MinP < 0 || s.MinP > 1 {
+		return fmt.Errorf("min-p must be in [0, 1], got %g", s.MinP)
+	}
+	return nil
+}
+
+// Кандидаты по убыванию веса, при равном весе — по алфавиту; токены
+// с нулевым весом не участвуют
+func sortedCandidates(weights map[string]float64) []candidate {
+	candidates := make([]candidate, 0, len(weights))
+	for token, weight := range weights {
+		if weight > 0 {
+			candidates = append(candidates, candidate{token, weight})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].weight != candidates[j].weight {
+			return candidates[i].weight > candidates[j].weight
+		}
+		return candidates[i].token < candidates[j].token
+	})
+	return candidates
+}
+
+// Отбираем кандидатов по настройкам: температура, top-k, top-p, min-p.
+// Результат отсортирован и нормирован
+func (s Sampling) filter(weights map[string]float64) []candidate {
+	candidates := sortedCandidates(weights)
+	if len(candidates) == 0 {
+		return nil
+	}
+	if s.Greedy {
+		return []candidate{{candidates[0].token, 1}}
+	}
+
+	if s.Temperature > 0 && s.Temperature != 1 {
+		// Степень считаем относительно максимального веса, чтобы не уйти в ноль
+		top := candidates[0].weight
+		for i := range candidates {
+			candidates[i].weight = math.Pow(candidates[i].weight/top, 1/s.Temperature)
+		}
+	}
+	normalize(candidates)
+
+	if s.TopK > 0 && len(candidates) > s.TopK {
+		candidates = candidates[:s.TopK]
+		normalize(candidates)
+	}
+
+	if s.TopP > 0 && s.TopP < 1 {
+		cumulative := 0.0
+		for i, c := range candidates {
+			cumulative += c.weight
+			if cumulative >= s.TopP {
+				candidates = candidates[:i+1]
+				break
+			}
+		}
+		normalize(candidates)
+	}
+
+	if s.MinP > 0 {
+		threshold := s.MinP * candidates[0].weight
+		kept := candidates[:0]
+		for _, c := range candidates {
+			if c.weight >= threshold {
+				kept = append(kept, c)
+			}
+		}
+		candidates = kept
+		normalize(candidates)
+	}
+
+	return candidates
+}
+
+// Приводим веса кандидатов к сумме 1
+func normalize(candidates []candidate) {
+	total := 0.0
+	for _, c := range candidates {
+		total += c.weight
+	}
+	if total == 0 {
+		return
+	}
+	for i := range candidates {
+		candidates[i].weight /= total
+	}
+}
+
+// Выбираем токен из отобранных кандидатов; пустая строка — выбирать не из чего
+func (s Sampling) sample(weights map[string]float64, rng *rand.Rand) string {
+	candidates := s.filter(weights)
+	if len(candidates) == 0 {
+		return ""
+	}
+	if len(candidates) == 1 {
+		return candidates[0].token
+	}
+
+	r := rng.Float64()
+	cumulative := 0.0
+	for _, c := range candidates {
+		cumulative += c.weight
+		if r < cumulative {
+			return c.token
+		}
+	}
+	return candidates[len(candidates)-1].token
+}
@@ -0,0 +1,239 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"markmach/tokenizer"
+	"markmach/trainer"
+)
+
+// Предельная длина одного предложения, если длина текста не ограничена
+const maxSentenceTokens = 100
+
+// Сколько пустых предложений подряд допускается, прежде чем текст
+// считается законченным
+const maxEmptySentences = 10
+
+// Генератор свободного текста без вопроса: блуждание по цепи от начала
+// предложения или от заданной фразы
+type TextGenerator struct {
+	answers *AnswerGenerator // Выбор токенов и борьба с повторами общие с генератором ответов
+}
+
+// Настройки генерации текста
+type TextOptions struct {
+	Count        int        // Число текстов (0 — один)
+	Prompt       string     // Начальная фраза первого предложения ("" — с начала предложения)
+	MaxTokens    int        // Предельная длина текста в токенах (0 — без предела)
+	MaxSentences int        // Предельное число предложений (0 — одно, если не задан MaxTokens, иначе без предела)
+	Seed         int64      // Зерно: одинаковые модель, зерно и настройки дают одинаковые тексты
+	Sampling     Sampling   // Настройки выбора следующего токена
+	Repetition   Repetition // Штрафы за повторы и обнаружение циклов
+}
+
+// Проверка настроек генерации текста
+func (o TextOptions) Validate() error {
+	if o.Count < 0 || o.MaxTokens < 0 || o.MaxSentences < 0 {
+		return fmt.Errorf("count and length limits must not be negative, got %d, %d and %d", o.Count, o.MaxTokens, o.MaxSentences)
+	}
+	if err := o.Sampling.Validate(); err != nil {
+		return fmt.Errorf("invalid sampling: %w", err)
+	}
+	if err := o.Repetition.Validate(); err != nil {
+		return fmt.Errorf("invalid repetition settings: %w", err)
+	}
+	return nil
+}
+
+// Создание генератора текста для модели
+func NewTextGenerator(chain *trainer.MarkovChain) *TextGenerator {
+	return &TextGenerator{
+		answers: &AnswerGenerator{
+			chain: chain,
+			tokenizer: tokenizer.NewTokenizer(tokenizer.Config{
+				KeepPunctuation: chain.Meta.Tokenizer.KeepPunctuation,
+				ToLowerCase:     true,
+			}),
+			tokenEntropy: make(map[string]float64),
+		},
+	}
+}
+
+// Генерируем тексты. При отмене контекста возвращаются уже готовые тексты
+// вместе с ошибкой контекста
+func (t *TextGenerator) Generate(ctx context.Context, opts TextOptions) ([]string, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Count == 0 {
+		opts.Count = 1
+	}
+	if opts.MaxSentences == 0 && opts.MaxTokens == 0 {
+		opts.MaxSentences = 1
+	}
+
+	g := t.answers
+	g.rng = rand.New(rand.NewSource(opts.Seed))
+	g.current = settings{sampling: opts.Sampling, repetition: opts.Repetition}
+
+	var prompt []string
+	for _, token := range g.tokenizer.Tokenize(opts.Prompt) {
+		if token != "<start>" && token != "<end>" {
+			prompt = append(prompt, token)
+		}
+	}
+
+	var texts []string
+	for len(texts) < opts.Count {
+		text, err := t.generateText(ctx, prompt, opts)
+		if err != nil {
+			return texts, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
+// Один текст из нескольких предложений; начальная фраза открывает первое
+func (t *TextGenerator) generateText(ctx context.Context, prompt []string, opts TextOptions) (string, error) {
+	g := t.answers
+	var sentences []string
+	tokens, empty := 0, 0
+
+	for opts.MaxSentences == 0 || len(sentences) < opts.MaxSentences {
+		if opts.MaxTokens > 0 && tokens >= opts.MaxTokens {
+			break
+		}
+		if empty >= maxEmptySentences {
+			break
+		}
+
+		var opening []string
+		if len(sentences) == 0 {
+			opening = t.openingWindow(prompt)
+			if opening == nil {
+				return "", fmt.Errorf("prompt %q has no continuation in the model", strings.Join(prompt, " "))
+			}
+		} else {
+			opening = t.openingWindow(nil)
+			if opening == nil {
+				break
+			}
+		}
+
+		// Повторы и возвраты в состояния цепи считаются внутри предложения:
+		// иначе начало каждого нового предложения было бы уже посещенным
+		sentence := opening
+		for {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			if opts.MaxTokens > 0 && tokens+contentLength(sentence) >= opts.MaxTokens {
+				break
+			}
+			if opts.MaxTokens == 0 && contentLength(sentence) >= maxSentenceTokens {
+				break
+			}
+
+			weights, stop := g.nextWeights(g.chain, sentence, nil)
+			if stop || len(weights) == 0 {
+				break
+			}
+			next := g.selectNextToken(weights)
+			if next == "<end>" || next == "" {
+				break
+			}
+			sentence = append(sentence, next)
+		}
+
+		formatted := g.formatAnswer(g.tokenizer.JoinTokens(sentence))
+		if !hasWords(sentence) || formatted == "" {
+			empty++
+			continue
+		}
+		empty = 0
+		tokens += contentLength(sentence)
+		sentences = append(sentences, formatted)
+	}
+
+	return strings.Join(sentences, " "), nil
+}
+
+// Начало предложения: <start> и начальная фраза, дополненные до префикса
+// цепи случайным префиксом, который с них начинается. Если с начала
+// предложения фраза в корпусе не встречается, она ищется в середине
+// предложений. nil — подходящего префикса нет
+func (t *TextGenerator) openingWindow(prompt []string) []string {
+	g := t.answers
+	candidates := [][]string{append([]string{"<start>"}, prompt...)}
+	if len(prompt) > 0 {
+		candidates = append(candidates, prompt)
+	}
+
+	for _, start := range candidates {
+		if len(start) >= g.chain.Order-1 || g.chain.IsVariableOrder() {
+			if len(g.chain.GetNextTokens(start[max(0, len(start)-g.chain.Order+1):])) > 0 {
+				return start
+			}
+			continue
+		}
+		if window := t.randomPrefix(start); window != nil {
+			return window
+		}
+	}
+	return nil
+}
+
+// Случайный префикс цепи, начинающийся с заданных токенов; префиксы
+// выбираются пропорционально числу переходов из них
+func (t *TextGenerator) randomPrefix(start []string) []string {
+	g := t.answers
+	var prefixes []string
+	total := 0
+	for prefix := range g.chain.Chain {
+		tokens := g.parsePrefix(prefix)
+		if len(tokens) == g.chain.Order-1 && equalTokens(tokens[:len(start)], start) {
+			prefixes = append(prefixes, prefix)
+			total += g.chain.Sums[prefix]
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	// Сортируем префиксы, чтобы выбор зависел только от случайного числа
+	sort.Strings(prefixes)
+	r := g.rng.Intn(max(total, 1))
+	for _, prefix := range prefixes {
+		r -= g.chain.Sums[prefix]
+		if r < 0 {
+			return g.parsePrefix(prefix)
+		}
+	}
+	return g.parsePrefix(prefixes[len(prefixes)-1])
+}
+
+// Число токенов без <start> и <end>
+func contentLength(tokens []string) int {
+	length := 0
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" {
+			length++
+		}
+	}
+	return length
+}
+
+// Есть ли среди токенов слова, а не только служебные токены и знаки препинания
+func hasWords(tokens []string) bool {
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" && !isPunctuation(token) {
+			return true
+		}
+	}
+	return false
+}
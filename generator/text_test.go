@@ -0,0 +1,49 @@
+package generator
+
+import (
+	"context"
+	"testing"
+
+	"markmach/trainer"
+)
+
+// Несколько предложений и бюджет токенов с настройками повторов по умолчанию:
+// генерация заканчивается и дает заказанный объем текста
+func TestTextGenerationEnds(t *testing.T) {
+	repetition := Repetition{NoRepeatNGram: 4, MaxStateVisits: 2}
+	cases := map[string]TextOptions{
+		"sentences": {MaxSentences: 5},
+		"tokens":    {MaxTokens: 40},
+	}
+	for _, order := range []int{2, 3} {
+		generator := NewTextGenerator(testChain(t, trainer.TrainConfig{Order: order}))
+		for name, opts := range cases {
+			opts.Seed = 1
+			opts.Sampling = Sampling{Temperature: 1, TopP: 1}
+			opts.Repetition = repetition
+
+			texts, err := generator.Generate(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("order %d, %s: generation failed: %v", order, name, err)
+			}
+			tokens := generator.answers.tokenizer.Tokenize(texts[0])
+			if opts.MaxSentences > 0 && countSentences(tokens) != opts.MaxSentences {
+				t.Fatalf("order %d: %q has %d sentences, expected %d", order, texts[0], countSentences(tokens), opts.MaxSentences)
+			}
+			if opts.MaxTokens > 0 && contentLength(tokens) < opts.MaxTokens/2 {
+				t.Fatalf("order %d: %q is far shorter than %d tokens", order, texts[0], opts.MaxTokens)
+			}
+		}
+	}
+}
+
+// Число предложений по завершающим знакам
+func countSentences(tokens []string) int {
+	count := 0
+	for _, token := range tokens {
+		if token == "." || token == "!" || token == "?" {
+			count++
+		}
+	}
+	return count
+}
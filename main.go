@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"markmach/generator"
+	"markmach/retrieval"
 	"markmach/textparser"
 	"markmach/tokenizer"
 	"markmach/trainer"
@@ -23,22 +31,145 @@ func main() {
 	tokenizeUseParagraphs := tokenizeCmd.Bool("paragraphs", false, "Use paragraphs for tokenization")
 
 	trainCmd := flag.NewFlagSet("train", flag.ExitOnError)
-	trainFile := trainCmd.String("file", "", "Path to the parsed data file")
+	trainFile := trainCmd.String("file", "", "Path to the parsed data file (comma-separated for several documents)")
 	modelPath := trainCmd.String("model", "output/markov_model.json", "Path to save the trained model")
 	order := trainCmd.Int("order", 3, "Order of Markov chain (2 for bigrams, 3 for trigrams, etc.)")
 	trainUseSentences := trainCmd.Bool("sentences", true, "Use sentences for training")
 	trainUseParagraphs := trainCmd.Bool("paragraphs", false, "Use paragraphs for training")
+	backups := trainCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+	continueFrom := trainCmd.String("continue-from", "", "Path to an existing model to continue training")
+	workers := trainCmd.Int("workers", 1, "Number of parallel training workers")
+	trainMinCount := trainCmd.Int("min-count", 0, "Drop transitions seen fewer times than this")
+	trainMinPrefix := trainCmd.Int("min-prefix", 0, "Drop prefixes with fewer total transitions than this")
+	trainTopK := trainCmd.Int("top-k", 0, "Keep only the K most frequent suffixes per prefix (0 keeps all)")
+	backoff := trainCmd.String("backoff", "", "Store all orders from 1 to N and back off to shorter contexts: stupid or katz")
+	smoothing := trainCmd.String("smoothing", "", "Probability smoothing: addk, wittenbell or kneserney")
+	smoothingK := trainCmd.Float64("smoothing-k", 1, "Constant added to each count for add-k smoothing")
+	trainBackward := trainCmd.Bool("backward", false, "Also train a right-to-left chain for generating around keywords")
+	trainSplit := trainCmd.String("split", "", "Train/validation/test ratios, e.g. 0.8,0.1,0.1 (empty trains on everything)")
+	trainSplitBy := trainCmd.String("split-by", "sentence", "Split unit: sentence or document")
+	trainSeed := trainCmd.Int64("seed", 1, "Seed for the corpus split and topic sampling")
+	trainTopics := trainCmd.Int("topics", 0, "Number of LDA topics to learn from paragraphs (0 to disable)")
+	trainTopicIterations := trainCmd.Int("topic-iterations", 200, "Number of Gibbs sampling passes for the topic model")
+	trainNoveltyNGram := trainCmd.Int("novelty-ngram", 0, "Store hashed corpus n-grams of this size for the generator novelty guard (0 to disable)")
+
+	autotuneCmd := flag.NewFlagSet("autotune", flag.ExitOnError)
+	autotuneFile := autotuneCmd.String("file", "", "Path to the parsed data file (comma-separated for several documents)")
+	autotuneModel := autotuneCmd.String("model", "output/markov_model.json", "Path to save the best model")
+	autotuneReport := autotuneCmd.String("report", "output/autotune_report.json", "Path to save the report of all candidates")
+	autotuneOrders := autotuneCmd.String("orders", "2,3,4", "Comma-separated candidate orders")
+	autotuneMinCounts := autotuneCmd.String("min-counts", "1,2", "Comma-separated candidate pruning thresholds")
+	autotuneSplit := autotuneCmd.String("split", "0.8,0.1,0.1", "Train/validation/test ratios")
+	autotuneSplitBy := autotuneCmd.String("split-by", "sentence", "Split unit: sentence or document")
+	autotuneSeed := autotuneCmd.Int64("seed", 1, "Seed for the corpus split")
+	autotuneUseSentences := autotuneCmd.Bool("sentences", true, "Use sentences for training")
+	autotuneUseParagraphs := autotuneCmd.Bool("paragraphs", false, "Use paragraphs for training")
+	autotuneBackoff := autotuneCmd.String("backoff", "", "Backoff strategy for all candidates: stupid or katz")
+	autotuneSmoothing := autotuneCmd.String("smoothing", "", "Smoothing for all candidates: addk, wittenbell or kneserney")
+	autotuneSmoothingK := autotuneCmd.Float64("smoothing-k", 1, "Constant added to each count for add-k smoothing")
+	autotuneBackups := autotuneCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+
+	mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	mergeModels := mergeCmd.String("models", "", "Comma-separated paths to the models to merge")
+	mergeWeights := mergeCmd.String("weights", "", "Comma-separated relative weights of the models (default 1 for each)")
+	mergeOut := mergeCmd.String("out", "output/merged_model.json", "Path to save the merged model")
+	mergeBackups := mergeCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	pruneModel := pruneCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	pruneOut := pruneCmd.String("out", "output/pruned_model.json", "Path to save the pruned model")
+	pruneMinCount := pruneCmd.Int("min-count", 2, "Drop transitions seen fewer times than this")
+	pruneMinPrefix := pruneCmd.Int("min-prefix", 0, "Drop prefixes with fewer total transitions than this")
+	pruneTopK := pruneCmd.Int("top-k", 0, "Keep only the K most frequent suffixes per prefix (0 keeps all)")
+	pruneHeldOut := pruneCmd.String("heldout", "", "Path to the parsed held-out data for perplexity")
+	pruneBackups := pruneCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+
+	evalCmd := flag.NewFlagSet("eval", flag.ExitOnError)
+	evalModel := evalCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	evalFile := evalCmd.String("file", "", "Path to the parsed held-out data")
+	evalJSON := evalCmd.Bool("json", false, "Print the report as JSON")
+	evalHistory := evalCmd.String("history", "", "Append the JSON report to this file (one report per line)")
+
+	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+	searchModel := searchCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	searchQuery := searchCmd.String("query", "", "Search query (AND, OR, NOT, \"phrases\", \"near words\"~N, prefix*, document:name, chapter:N)")
+	searchLimit := searchCmd.Int("limit", 10, "Maximum number of sentences to print (0 prints all)")
+	searchColor := searchCmd.Bool("color", false, "Highlight matched words with terminal colors instead of asterisks")
+
+	exportCmd := flag.NewFlagSet("export-arpa", flag.ExitOnError)
+	exportModel := exportCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	exportOut := exportCmd.String("out", "output/markov_model.arpa", "Path to save the ARPA file")
+
+	importCmd := flag.NewFlagSet("import-arpa", flag.ExitOnError)
+	importFile := importCmd.String("file", "", "Path to the ARPA file")
+	importModel := importCmd.String("model", "output/markov_model.json", "Path to save the imported model")
+	importIndex := importCmd.String("index", "", "Path to parsed data to build the search index for chat (comma-separated for several)")
+	importBackups := importCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+
+	statsCmd := flag.NewFlagSet("recompute-stats", flag.ExitOnError)
+	statsModel := statsCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	statsOut := statsCmd.String("out", "", "Path to save the model (defaults to --model)")
+	statsBackups := statsCmd.Int("backups", 0, "Number of previous model versions to keep as backups")
+
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	generateModel := generateCmd.String("model", "output/markov_model.json", "Path to the trained model")
+	generateCount := generateCmd.Int("count", 1, "Number of texts to generate")
+	generatePrompt := generateCmd.String("prompt", "", "Phrase to start the first sentence with (empty starts a sentence from scratch)")
+	generateTokens := generateCmd.Int("tokens", 0, "Maximum text length in tokens (0 for no limit)")
+	generateSentences := generateCmd.Int("sentences", 0, "Maximum number of sentences per text (0 for one, or no limit with --tokens)")
+	generateOut := generateCmd.String("out", "", "File to write texts to, one per line (empty prints them)")
+	generateSeed := generateCmd.Int64("seed", 0, "Seed for reproducible texts (random if not set)")
+	generateTemperature := generateCmd.Float64("temperature", 1.0, "Sampling temperature: below 1 is more focused, above 1 more diverse")
+	generateTopK := generateCmd.Int("top-k", 0, "Sample only from the k most probable tokens (0 for all)")
+	generateTopP := generateCmd.Float64("top-p", 1.0, "Sample from the smallest set of tokens with total probability p")
+	generateNoRepeatNGram := generateCmd.Int("no-repeat-ngram", 4, "Block repeating n-grams of this size (0 to allow)")
+	generateMaxStateVisits := generateCmd.Int("max-state-visits", 2, "Times a chain state may recur before its earlier continuations are avoided (0 to disable)")
 
 	chatCmd := flag.NewFlagSet("chat", flag.ExitOnError)
 	chatModelPath := chatCmd.String("model", "output/markov_model.json", "Path to the trained model")
 	maxLength := chatCmd.Int("length", 50, "Maximum answer length in tokens")
 	maxEntropy := chatCmd.Float64("entropy", 2.0, "Max entropy for thematic tokens")
+	chatSeed := chatCmd.Int64("seed", 0, "Seed for reproducible answers (random if not set)")
+	chatGreedy := chatCmd.Bool("greedy", false, "Always pick the most probable next token")
+	chatTemperature := chatCmd.Float64("temperature", 1.0, "Sampling temperature: below 1 is more focused, above 1 more diverse")
+	chatTopK := chatCmd.Int("top-k", 0, "Sample only from the k most probable tokens (0 for all)")
+	chatTopP := chatCmd.Float64("top-p", 1.0, "Sample from the smallest set of tokens with total probability p")
+	chatMinP := chatCmd.Float64("min-p", 0, "Drop tokens less probable than min-p times the most probable one")
+	chatDecode := chatCmd.String("decode", "sample", "Answer search: sample, nbest (sample N and rerank) or beam")
+	chatCandidates := chatCmd.Int("candidates", 5, "Number of candidates for nbest or beam width for beam")
+	defaultWeights := generator.DefaultScoreWeights()
+	chatScoreLogProb := chatCmd.Float64("score-logprob", defaultWeights.LogProb, "Weight of the length-normalised model log-probability in candidate scores")
+	chatScoreCoverage := chatCmd.Float64("score-coverage", defaultWeights.Coverage, "Weight of question keyword coverage in candidate scores")
+	chatScoreNovelty := chatCmd.Float64("score-novelty", defaultWeights.Novelty, "Weight of novelty against the corpus in candidate scores")
+	chatRequire := chatCmd.String("require", "", "Comma-separated words every answer must contain")
+	chatBan := chatCmd.String("ban", "", "Comma-separated words answers must never contain")
+	chatBanFile := chatCmd.String("ban-file", "", "Files with banned words, one or more per line (comma-separated for several)")
+	chatRetries := chatCmd.Int("retries", 10, "Maximum number of retries when an answer violates the constraints")
+	chatFrequencyPenalty := chatCmd.Float64("frequency-penalty", 0, "Penalty for each earlier occurrence of a word in the answer")
+	chatPresencePenalty := chatCmd.Float64("presence-penalty", 0, "Penalty for words that already occurred in the answer")
+	chatNoRepeatNGram := chatCmd.Int("no-repeat-ngram", 4, "Block repeating n-grams of this size (0 to allow)")
+	chatMaxStateVisits := chatCmd.Int("max-state-visits", 2, "Times a chain state may recur before its earlier continuations are avoided (0 to disable)")
+	chatNoveltyGuard := chatCmd.String("novelty-guard", "", "Reject answers copying n-grams from the corpus (reject) or also avoid them while generating (resample); needs --novelty-ngram at training")
+	chatSentences := chatCmd.Int("sentences", 0, "Target number of sentences per answer (0 for one, or as many as fit --chars)")
+	chatChars := chatCmd.Int("chars", 0, "Maximum answer length in characters (0 for no limit)")
+	chatMemoryDecay := chatCmd.Float64("memory-decay", 0.5, "How much of the earlier questions' keywords and topic each turn keeps, between 0 and 1 (0 disables conversation memory)")
+	chatLengthPenalty := chatCmd.Float64("length-penalty", defaultWeights.LengthPenalty, "Exponent of answer length when normalising log-probability (0 sums, 1 averages)")
 
 	if len(os.Args) < 2 {
 		fmt.Println("Expected 'parse', 'tokenize' or 'train' subcommand")
 		fmt.Println("Usage: go run main.go parse --file path/to/file.txt")
 		fmt.Println("Usage: go run main.go tokenize --file path/to/parsed_data.txt [--punctuation] [--sentences|--paragraphs]")
-		fmt.Println("Usage: go run main.go train --file path/to/parsed_data.txt [--order 3] [--sentences|--paragraphs] [--model output/model.json]")
+		fmt.Println("Usage: go run main.go train --file path/to/parsed_data.txt [--order 3] [--sentences|--paragraphs] [--model output/model.json] [--backups 3] [--continue-from output/model.json] [--workers 4] [--min-count 2] [--min-prefix 3] [--top-k 10] [--backoff stupid|katz] [--smoothing addk|wittenbell|kneserney] [--backward] [--topics 8 --topic-iterations 200] [--novelty-ngram 6] [--split 0.8,0.1,0.1 --split-by sentence|document --seed 1]")
+		fmt.Println("Usage: go run main.go prune --model output/model.json [--out output/pruned_model.json] [--min-count 2] [--min-prefix 3] [--top-k 10] [--heldout path/to/parsed_data]")
+		fmt.Println("Usage: go run main.go eval --file path/to/heldout_data [--model output/model.json] [--json] [--history output/eval.jsonl]")
+		fmt.Println("Usage: go run main.go autotune --file a,b [--orders 2,3,4] [--min-counts 1,2] [--split 0.8,0.1,0.1] [--split-by sentence|document] [--seed 1]")
+		fmt.Println("Usage: go run main.go merge --models a.json,b.json [--weights 1,0.5] [--out output/merged_model.json]")
+		fmt.Println("Usage: go run main.go search [--model output/model.json] [--limit 10] [--color] --query '\"цепь маркова\" AND NOT граф* chapter:2'")
+		fmt.Println("Usage: go run main.go export-arpa [--model output/model.json] [--out output/model.arpa]")
+		fmt.Println("Usage: go run main.go import-arpa --file model.arpa [--model output/model.json] [--index path/to/parsed_data]")
+		fmt.Println("Usage: go run main.go chat [--model output/model.json] [--length 50] [--seed 42] [--greedy] [--temperature 0.8] [--top-k 10] [--top-p 0.9] [--min-p 0.05] [--decode sample|nbest|beam --candidates 5] [--score-logprob 1 --score-coverage 2 --score-novelty 0.5 --length-penalty 1] [--require a,b] [--ban c,d] [--ban-file banned.txt] [--retries 10] [--frequency-penalty 0.5] [--presence-penalty 0.5] [--no-repeat-ngram 4] [--max-state-visits 2] [--novelty-guard reject|resample] [--sentences 3] [--chars 400] [--memory-decay 0.5]")
+		fmt.Println("Usage: go run main.go generate [--model output/model.json] [--count 100] [--prompt 'цепь маркова'] [--tokens 50] [--sentences 3] [--out synthetic.txt] [--seed 42] [--temperature 0.8] [--top-k 10] [--top-p 0.9] [--no-repeat-ngram 4] [--max-state-visits 2]")
+		fmt.Println("Usage: go run main.go recompute-stats [--model output/model.json] [--out output/model.json]")
 		os.Exit(1)
 	}
 
@@ -173,44 +304,101 @@ func main() {
 			os.Exit(1)
 		}
 
-		parser := textparser.NewTextParser()
-		result, err := parser.LoadParsedData(*trainFile)
-		if err != nil {
-			log.Fatalf("Error loading parsed data: %v", err)
-		}
-
 		tokenizerConfig := tokenizer.Config{
 			KeepPunctuation: true,
 			ToLowerCase:     true,
 		}
 		tkz := tokenizer.NewTokenizer(tokenizerConfig)
 
-		var tokenizedData [][]string
+		files := splitList(*trainFile)
+		unit := trainingUnit(*trainUseSentences, *trainUseParagraphs)
+		documents, err := loadDocuments(files, tkz, unit)
+		if err != nil {
+			log.Fatalf("Error loading parsed data: %v", err)
+		}
 
-		if *trainUseSentences {
-			tokenizedData = tkz.TokenizeSentences(result.Sentences)
-			fmt.Printf("Training on %d sentences...\n", len(tokenizedData))
-		} else if *trainUseParagraphs {
-			tokenizedData = tkz.TokenizeSentences(result.Paragraphs)
-			fmt.Printf("Training on %d paragraphs...\n", len(tokenizedData))
+		var split trainer.Split
+		var splitConfig *trainer.SplitConfig
+		trainDocuments := documents
+		if *trainSplit != "" {
+			splitConfig, err = parseSplitConfig(*trainSplit, *trainSplitBy, *trainSeed)
+			if err != nil {
+				log.Fatalf("Error parsing split: %v", err)
+			}
+			// Абзацы нельзя разделить между частями по предложениям, а без них
+			// темы учились бы на отдельных предложениях
+			if *trainTopics > 0 && splitConfig.By != trainer.SplitByDocument {
+				log.Fatalf("--topics learns from paragraphs, which a split by %s drops; use --split-by %s", splitConfig.By, trainer.SplitByDocument)
+			}
+			split, err = trainer.SplitCorpus(documents, *splitConfig)
+			if err != nil {
+				log.Fatalf("Error splitting corpus: %v", err)
+			}
+			trainDocuments = split.Train
+			fmt.Printf("Split by %s: %d train, %d validation, %d test %s\n", splitConfig.By, len(trainer.Sentences(trainDocuments)),
+				len(trainer.Sentences(split.Validation)), len(trainer.Sentences(split.Test)), unit)
+		}
+
+		if unit == "text" {
+			fmt.Printf("Training on full text of %d file(s)...\n", len(files))
 		} else {
-			tokenizedData = [][]string{tkz.Tokenize(result.RawText)}
-			fmt.Printf("Training on full text...\n")
+			fmt.Printf("Training on %d %s...\n", len(trainer.Sentences(trainDocuments)), unit)
 		}
 
 		trainConfig := trainer.TrainConfig{
 			Order:     *order,
 			SaveModel: true,
 			ModelPath: *modelPath,
+			Tokenizer: tokenizerConfig,
+			Unit:      unit,
+			Workers:   *workers,
+
+			MinFrequency: *trainMinCount,
+			MinPrefix:    *trainMinPrefix,
+			TopK:         *trainTopK,
+			Backoff:      *backoff,
+			Smoothing:    *smoothing,
+			SmoothingK:   *smoothingK,
+			Backward:     *trainBackward,
+
+			Topics:          *trainTopics,
+			TopicIterations: *trainTopicIterations,
+			TopicSeed:       *trainSeed,
+
+			NoveltyNGram: *trainNoveltyNGram,
+		}
+		if *trainTopics < 0 {
+			log.Fatalf("Invalid number of topics: %d", *trainTopics)
+		}
+		if *trainNoveltyNGram < 0 {
+			log.Fatalf("Invalid novelty n-gram size: %d", *trainNoveltyNGram)
+		}
+
+		var markovTrainer *trainer.MarkovChain
+		if *continueFrom != "" {
+			if !isFlagSet(trainCmd, "order") {
+				trainConfig.Order = 0
+			}
+			markovTrainer, err = trainer.ContinueTraining(*continueFrom, trainConfig)
+			if err != nil {
+				log.Fatalf("Error loading model to continue training: %v", err)
+			}
+		} else {
+			markovTrainer = trainer.NewMarkovTrainer(trainConfig)
+		}
+
+		err = markovTrainer.RecordCorpus(parsedFiles(files))
+		if err != nil {
+			log.Fatalf("Error hashing corpus: %v", err)
 		}
 
-		markovTrainer := trainer.NewMarkovTrainer(trainConfig)
-		err = markovTrainer.Train(tokenizedData)
+		err = markovTrainer.TrainDocuments(trainDocuments)
 		if err != nil {
 			log.Fatalf("Error training model: %v", err)
 		}
+		markovTrainer.Meta.Training.Split = splitConfig
 
-		err = markovTrainer.Save(*modelPath)
+		err = markovTrainer.SaveWithOptions(*modelPath, trainer.SaveOptions{Backups: *backups})
 		if err != nil {
 			log.Fatalf("Error saving model: %v", err)
 		}
@@ -221,6 +409,16 @@ func main() {
 			fmt.Printf("%s: %v\n", key, value)
 		}
 
+		if splitConfig != nil {
+			fmt.Println("\n=== Held-out Evaluation ===")
+			if validation := trainer.Sentences(split.Validation); len(validation) > 0 {
+				fmt.Printf("Validation perplexity: %.3f\n", markovTrainer.Perplexity(validation))
+			}
+			if test := trainer.Sentences(split.Test); len(test) > 0 {
+				fmt.Printf("Test perplexity: %.3f\n", markovTrainer.Perplexity(test))
+			}
+		}
+
 		fmt.Println("\n=== Chain Examples ===")
 		exampleCount := 0
 		for prefix, suffixes := range markovTrainer.Chain {
@@ -235,6 +433,398 @@ func main() {
 			exampleCount++
 		}
 
+	case "autotune":
+		autotuneCmd.Parse(os.Args[2:])
+		if *autotuneFile == "" {
+			fmt.Println("Please provide a file path using --file flag")
+			os.Exit(1)
+		}
+
+		orders, err := parseIntList(*autotuneOrders)
+		if err != nil {
+			log.Fatalf("Invalid --orders: %v", err)
+		}
+		minCounts, err := parseIntList(*autotuneMinCounts)
+		if err != nil {
+			log.Fatalf("Invalid --min-counts: %v", err)
+		}
+		splitConfig, err := parseSplitConfig(*autotuneSplit, *autotuneSplitBy, *autotuneSeed)
+		if err != nil {
+			log.Fatalf("Error parsing split: %v", err)
+		}
+
+		tokenizerConfig := tokenizer.Config{
+			KeepPunctuation: true,
+			ToLowerCase:     true,
+		}
+		tkz := tokenizer.NewTokenizer(tokenizerConfig)
+
+		files := splitList(*autotuneFile)
+		unit := trainingUnit(*autotuneUseSentences, *autotuneUseParagraphs)
+		documents, err := loadDocuments(files, tkz, unit)
+		if err != nil {
+			log.Fatalf("Error loading parsed data: %v", err)
+		}
+
+		split, err := trainer.SplitCorpus(documents, *splitConfig)
+		if err != nil {
+			log.Fatalf("Error splitting corpus: %v", err)
+		}
+
+		tuneConfig := trainer.TuneConfig{
+			Base: trainer.TrainConfig{
+				Tokenizer:  tokenizerConfig,
+				Unit:       unit,
+				Backoff:    *autotuneBackoff,
+				Smoothing:  *autotuneSmoothing,
+				SmoothingK: *autotuneSmoothingK,
+			},
+			Orders:    orders,
+			MinCounts: minCounts,
+		}
+
+		best, report, err := trainer.AutoTune(split, tuneConfig)
+		if err != nil {
+			log.Fatalf("Error tuning model: %v", err)
+		}
+		report.Split = *splitConfig
+
+		err = best.RecordCorpus(parsedFiles(files))
+		if err != nil {
+			log.Fatalf("Error hashing corpus: %v", err)
+		}
+		best.Meta.Training.Split = splitConfig
+
+		err = best.SaveWithOptions(*autotuneModel, trainer.SaveOptions{Backups: *autotuneBackups})
+		if err != nil {
+			log.Fatalf("Error saving model: %v", err)
+		}
+
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Error encoding report: %v", err)
+		}
+		err = os.MkdirAll(filepath.Dir(*autotuneReport), 0755)
+		if err == nil {
+			err = os.WriteFile(*autotuneReport, data, 0644)
+		}
+		if err != nil {
+			log.Fatalf("Error saving report: %v", err)
+		}
+
+		fmt.Println("\n=== Autotune Candidates ===")
+		for i, candidate := range report.Candidates {
+			marker := " "
+			if i == report.Best {
+				marker = "*"
+			}
+			fmt.Printf("%s order %d, min count %d: validation perplexity %.3f, %d prefixes, %d transitions\n",
+				marker, candidate.Order, candidate.MinCount, candidate.Validation.Perplexity,
+				candidate.Prefixes, candidate.Transitions)
+		}
+		if report.Test != nil {
+			fmt.Printf("\nBest model test perplexity: %.3f\n", report.Test.Perplexity)
+		}
+		fmt.Printf("Report saved to %s\n", *autotuneReport)
+
+	case "merge":
+		mergeCmd.Parse(os.Args[2:])
+		if *mergeModels == "" {
+			fmt.Println("Please provide model paths using --models flag")
+			os.Exit(1)
+		}
+
+		paths := splitList(*mergeModels)
+		var weights []float64
+		if *mergeWeights != "" {
+			for _, w := range strings.Split(*mergeWeights, ",") {
+				weight, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+				if err != nil {
+					log.Fatalf("Invalid weight %q: %v", w, err)
+				}
+				weights = append(weights, weight)
+			}
+		}
+
+		var models []*trainer.MarkovChain
+		for _, path := range paths {
+			model, err := trainer.Load(path)
+			if err != nil {
+				log.Fatalf("Error loading model: %v", err)
+			}
+			models = append(models, model)
+		}
+
+		merged, err := trainer.Merge(models, weights)
+		if err != nil {
+			log.Fatalf("Error merging models: %v", err)
+		}
+
+		err = merged.SaveWithOptions(*mergeOut, trainer.SaveOptions{Backups: *mergeBackups})
+		if err != nil {
+			log.Fatalf("Error saving model: %v", err)
+		}
+
+		stats := merged.GetStats()
+		fmt.Println("\n=== Merged Model Statistics ===")
+		for key, value := range stats {
+			fmt.Printf("%s: %v\n", key, value)
+		}
+
+	case "prune":
+		pruneCmd.Parse(os.Args[2:])
+
+		markovChain, err := trainer.Load(*pruneModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+		if markovChain.Backoff == trainer.BackoffARPA {
+			log.Fatalf("Cannot prune %s: model was imported from ARPA and has no counts", *pruneModel)
+		}
+
+		var heldOut [][]string
+		perplexityBefore := 0.0
+		if *pruneHeldOut != "" {
+			heldOut, err = loadHeldOut(*pruneHeldOut, markovChain)
+			if err != nil {
+				log.Fatalf("Error loading held-out data: %v", err)
+			}
+			perplexityBefore = markovChain.Perplexity(heldOut)
+		}
+
+		report := markovChain.Prune(trainer.PruneConfig{
+			MinCount:       *pruneMinCount,
+			MinPrefixCount: *pruneMinPrefix,
+			TopK:           *pruneTopK,
+		})
+
+		err = markovChain.SaveWithOptions(*pruneOut, trainer.SaveOptions{Backups: *pruneBackups})
+		if err != nil {
+			log.Fatalf("Error saving model: %v", err)
+		}
+
+		fmt.Println("\n=== Pruning Report ===")
+		fmt.Printf("Prefixes: %d -> %d\n", report.PrefixesBefore, report.PrefixesAfter)
+		fmt.Printf("Transitions: %d -> %d\n", report.TransitionsBefore, report.TransitionsAfter)
+		if heldOut != nil {
+			perplexityAfter := markovChain.Perplexity(heldOut)
+			fmt.Printf("Held-out perplexity: %.3f -> %.3f (%+.2f%%)\n",
+				perplexityBefore, perplexityAfter, 100*(perplexityAfter-perplexityBefore)/perplexityBefore)
+		}
+
+	case "eval":
+		evalCmd.Parse(os.Args[2:])
+		if *evalFile == "" {
+			fmt.Println("Please provide a held-out data path using --file flag")
+			os.Exit(1)
+		}
+
+		markovChain, err := trainer.Load(*evalModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+
+		heldOut, err := loadHeldOut(*evalFile, markovChain)
+		if err != nil {
+			log.Fatalf("Error loading held-out data: %v", err)
+		}
+
+		report := markovChain.Evaluate(heldOut)
+		report.Model = *evalModel
+		report.Corpus = *evalFile
+		if report.Tokens == report.OOVTokens {
+			log.Fatalf("Held-out data has no in-vocabulary tokens")
+		}
+
+		data, err := json.Marshal(report)
+		if err != nil {
+			log.Fatalf("Error encoding report: %v", err)
+		}
+
+		if *evalJSON {
+			fmt.Println(string(data))
+		} else {
+			printEvalReport(report)
+		}
+
+		if *evalHistory != "" {
+			err = appendLine(*evalHistory, data)
+			if err != nil {
+				log.Fatalf("Error writing report history: %v", err)
+			}
+		}
+
+	case "search":
+		searchCmd.Parse(os.Args[2:])
+		queryText := *searchQuery
+		if queryText == "" {
+			queryText = strings.Join(searchCmd.Args(), " ")
+		}
+		if strings.TrimSpace(queryText) == "" {
+			fmt.Println("Please provide a query using --query flag")
+			os.Exit(1)
+		}
+
+		query, err := retrieval.ParseQuery(queryText)
+		if err != nil {
+			log.Fatalf("Invalid query: %v", err)
+		}
+
+		markovChain, err := trainer.Load(*searchModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+
+		open, close := "*", "*"
+		if *searchColor {
+			open, close = "\033[1;33m", "\033[0m"
+		}
+
+		results := markovChain.Index.Find(query, 0)
+		fmt.Printf("\n=== Search: %s ===\n", query)
+		fmt.Printf("Found %d sentences\n", len(results))
+		for i, result := range results {
+			if *searchLimit > 0 && i >= *searchLimit {
+				break
+			}
+			fmt.Printf("\n%d. (score %.3f) %s\n", i+1, result.Score, provenance(result.Document))
+			fmt.Printf("   %s\n", retrieval.Highlight(result.Document.Text, result.Matched, open, close))
+		}
+
+	case "export-arpa":
+		exportCmd.Parse(os.Args[2:])
+
+		markovChain, err := trainer.Load(*exportModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+
+		err = markovChain.ExportARPA(*exportOut)
+		if err != nil {
+			log.Fatalf("Error exporting model: %v", err)
+		}
+
+	case "import-arpa":
+		importCmd.Parse(os.Args[2:])
+		if *importFile == "" {
+			fmt.Println("Please provide an ARPA file path using --file flag")
+			os.Exit(1)
+		}
+
+		tokenizerConfig := tokenizer.Config{
+			KeepPunctuation: true,
+			ToLowerCase:     true,
+		}
+		markovChain, err := trainer.ImportARPA(*importFile, trainer.TrainConfig{
+			Tokenizer: tokenizerConfig,
+			Unit:      "unknown",
+		})
+		if err != nil {
+			log.Fatalf("Error importing model: %v", err)
+		}
+
+		if *importIndex != "" {
+			documents, err := loadDocuments(splitList(*importIndex), tokenizer.NewTokenizer(tokenizerConfig), "sentences")
+			if err != nil {
+				log.Fatalf("Error loading parsed data: %v", err)
+			}
+			markovChain.IndexDocuments(documents)
+			markovChain.RecomputeStats()
+			fmt.Printf("Index size: %d words in %d sentences\n", markovChain.Index.Terms(), markovChain.Index.Len())
+		}
+
+		err = markovChain.SaveWithOptions(*importModel, trainer.SaveOptions{Backups: *importBackups})
+		if err != nil {
+			log.Fatalf("Error saving model: %v", err)
+		}
+
+	case "recompute-stats":
+		statsCmd.Parse(os.Args[2:])
+		if *statsOut == "" {
+			*statsOut = *statsModel
+		}
+
+		markovChain, err := trainer.Load(*statsModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+
+		markovChain.RecomputeStats()
+		stats := markovChain.Stats
+		fmt.Printf("Token statistics: %d tokens, entropy range [%.3f, %.3f]\n", len(stats.Tokens), stats.MinEntropy, stats.MaxEntropy)
+		fmt.Println("\n=== Top Thematic Tokens ===")
+		for i, token := range stats.TopThematic(10) {
+			tokenStats := stats.Tokens[token]
+			fmt.Printf("%d. %s (entropy: %.3f, frequency: %d, idf: %.3f)\n", i+1, token, tokenStats.Entropy, tokenStats.Frequency, tokenStats.IDF)
+		}
+
+		err = markovChain.SaveWithOptions(*statsOut, trainer.SaveOptions{Backups: *statsBackups})
+		if err != nil {
+			log.Fatalf("Error saving model: %v", err)
+		}
+
+	case "generate":
+		generateCmd.Parse(os.Args[2:])
+
+		markovChain, err := trainer.Load(*generateModel)
+		if err != nil {
+			log.Fatalf("Error loading model: %v", err)
+		}
+
+		if !isFlagSet(generateCmd, "seed") {
+			*generateSeed = time.Now().UnixNano()
+		}
+		fmt.Printf("Seed: %d\n", *generateSeed)
+
+		options := generator.TextOptions{
+			Count:        *generateCount,
+			Prompt:       *generatePrompt,
+			MaxTokens:    *generateTokens,
+			MaxSentences: *generateSentences,
+			Seed:         *generateSeed,
+			Sampling: generator.Sampling{
+				Temperature: *generateTemperature,
+				TopK:        *generateTopK,
+				TopP:        *generateTopP,
+			},
+			Repetition: generator.Repetition{
+				NoRepeatNGram:  *generateNoRepeatNGram,
+				MaxStateVisits: *generateMaxStateVisits,
+			},
+		}
+		if err := options.Sampling.Validate(); err != nil {
+			log.Fatalf("Invalid sampling settings: %v", err)
+		}
+		if err := options.Repetition.Validate(); err != nil {
+			log.Fatalf("Invalid repetition settings: %v", err)
+		}
+
+		// По Ctrl+C сохраняем уже готовые тексты
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		texts, err := generator.NewTextGenerator(markovChain).Generate(ctx, options)
+		if err != nil && len(texts) == 0 {
+			log.Fatalf("Error generating text: %v", err)
+		}
+		if err != nil {
+			fmt.Printf("Generation stopped after %d texts: %v\n", len(texts), err)
+		}
+
+		if *generateOut == "" {
+			for _, text := range texts {
+				fmt.Println(text)
+			}
+			break
+		}
+		data := strings.Join(texts, "\n") + "\n"
+		if err := os.MkdirAll(filepath.Dir(*generateOut), 0755); err != nil {
+			log.Fatalf("Error creating output directory: %v", err)
+		}
+		if err := os.WriteFile(*generateOut, []byte(data), 0644); err != nil {
+			log.Fatalf("Error writing texts: %v", err)
+		}
+		fmt.Printf("Wrote %d texts to %s\n", len(texts), *generateOut)
+
 	case "chat":
 		chatCmd.Parse(os.Args[2:])
 
@@ -244,17 +834,94 @@ func main() {
 			log.Fatalf("Error loading model: %v", err)
 		}
 
+		sampling := generator.Sampling{
+			Greedy:      *chatGreedy,
+			Temperature: *chatTemperature,
+			TopK:        *chatTopK,
+			TopP:        *chatTopP,
+			MinP:        *chatMinP,
+		}
+		if err := sampling.Validate(); err != nil {
+			log.Fatalf("Invalid sampling settings: %v", err)
+		}
+		decoding := generator.Decoding{
+			Mode:       *chatDecode,
+			Candidates: *chatCandidates,
+			Weights: generator.ScoreWeights{
+				LogProb:       *chatScoreLogProb,
+				Coverage:      *chatScoreCoverage,
+				Novelty:       *chatScoreNovelty,
+				LengthPenalty: *chatLengthPenalty,
+			},
+		}
+		if err := decoding.Validate(); err != nil {
+			log.Fatalf("Invalid decoding settings: %v", err)
+		}
+		constraints := generator.Constraints{
+			Required:   splitList(*chatRequire),
+			Banned:     splitList(*chatBan),
+			MaxRetries: *chatRetries,
+		}
+		for _, path := range splitList(*chatBanFile) {
+			words, err := generator.LoadWordList(path)
+			if err != nil {
+				log.Fatalf("Error loading banned words: %v", err)
+			}
+			constraints.Banned = append(constraints.Banned, words...)
+		}
+		if err := constraints.Validate(); err != nil {
+			log.Fatalf("Invalid constraints: %v", err)
+		}
+		repetition := generator.Repetition{
+			FrequencyPenalty: *chatFrequencyPenalty,
+			PresencePenalty:  *chatPresencePenalty,
+			NoRepeatNGram:    *chatNoRepeatNGram,
+			MaxStateVisits:   *chatMaxStateVisits,
+		}
+		if err := repetition.Validate(); err != nil {
+			log.Fatalf("Invalid repetition settings: %v", err)
+		}
+		novelty := generator.NoveltyGuard{Mode: *chatNoveltyGuard}
+		if err := novelty.Validate(); err != nil {
+			log.Fatalf("Invalid novelty guard: %v", err)
+		}
+		if err := novelty.Check(markovChain); err != nil {
+			log.Fatalf("Invalid novelty guard: %v", err)
+		}
+		if *chatMemoryDecay != 0 {
+			if _, err := generator.NewDialogue(*chatMemoryDecay); err != nil {
+				log.Fatalf("Invalid conversation memory: %v", err)
+			}
+		}
+		length := generator.AnswerLength{Sentences: *chatSentences, Characters: *chatChars}
+		if err := length.Validate(); err != nil {
+			log.Fatalf("Invalid answer length: %v", err)
+		}
+
+		if !isFlagSet(chatCmd, "seed") {
+			*chatSeed = time.Now().UnixNano()
+		}
+		fmt.Printf("Seed: %d\n", *chatSeed)
+
 		generatorConfig := generator.Config{
 			MaxLength:          *maxLength,
-			UsePunctuation:     true,
+			UsePunctuation:     markovChain.Meta.Tokenizer.KeepPunctuation,
 			MaxThematicEntropy: *maxEntropy,
+			Seed:               *chatSeed,
+			Sampling:           sampling,
+			Decoding:           decoding,
+			Constraints:        constraints,
+			Repetition:         repetition,
+			Novelty:            novelty,
+			Length:             length,
+			MemoryDecay:        *chatMemoryDecay,
 		}
 
 		answerGenerator := generator.NewAnswerGenerator(markovChain, generatorConfig)
 		answerGenerator.InteractiveMode()
 
 	default:
-		fmt.Println("Expected 'parse', 'tokenize', 'train' or 'chat' subcommand")
+		fmt.Println("Expected 'parse', 'tokenize', 'train', 'autotune', 'merge', 'prune', 'eval', 'search', 'export-arpa', 'import-arpa', 'recompute-stats', 'generate' or 'chat' subcommand")
 		os.Exit(1)
 	}
 }
@@ -285,3 +952,165 @@ func saveTokenizedData(sentences [][]string, vocab map[string]int, baseFilename
 
 	return nil
 }
+
+// Проверяем, был ли флаг указан явно
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Загрузка и токенизация отложенного корпуса с настройками модели
+func loadHeldOut(path string, markovChain *trainer.MarkovChain) ([][]string, error) {
+	tkz := tokenizer.NewTokenizer(markovChain.Meta.Tokenizer)
+	documents, err := loadDocuments(splitList(path), tkz, markovChain.Meta.Training.Unit)
+	if err != nil {
+		return nil, err
+	}
+	return trainer.Sentences(documents), nil
+}
+
+// Загрузка корпуса: каждый спарсенный файл становится отдельным документом
+func loadDocuments(files []string, tkz *tokenizer.Tokenizer, unit string) ([]trainer.Document, error) {
+	parser := textparser.NewTextParser()
+
+	var documents []trainer.Document
+	for _, file := range files {
+		result, err := parser.LoadParsedData(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		document := trainer.Document{Name: filepath.Base(file)}
+		switch unit {
+		case "paragraphs":
+			document.Sentences = tkz.TokenizeSentences(result.Paragraphs)
+		case "text":
+			document.Sentences = [][]string{tkz.Tokenize(result.RawText)}
+			document.Paragraphs = tkz.TokenizeSentences(result.Paragraphs)
+		default:
+			document.Sentences = tkz.TokenizeSentences(result.Sentences)
+			document.Paragraphs = tkz.TokenizeSentences(result.Paragraphs)
+		}
+		documents = append(documents, document)
+	}
+
+	return documents, nil
+}
+
+// Файлы, из которых состоит спарсенный корпус
+func parsedFiles(files []string) []string {
+	parser := textparser.NewTextParser()
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, parser.ParsedFiles(file)...)
+	}
+	return paths
+}
+
+// Единица обучения по флагам --sentences и --paragraphs
+func trainingUnit(useSentences, useParagraphs bool) string {
+	if useSentences {
+		return "sentences"
+	}
+	if useParagraphs {
+		return "paragraphs"
+	}
+	return "text"
+}
+
+// Настройки разбиения корпуса из флагов
+func parseSplitConfig(ratios, by string, seed int64) (*trainer.SplitConfig, error) {
+	train, validation, test, err := trainer.ParseSplitRatios(ratios)
+	if err != nil {
+		return nil, err
+	}
+	return &trainer.SplitConfig{
+		Train:      train,
+		Validation: validation,
+		Test:       test,
+		By:         by,
+		Seed:       seed,
+	}, nil
+}
+
+// Откуда взято предложение: документ, глава и номер
+func provenance(document retrieval.Document) string {
+	source := document.Source
+	if source == "" {
+		source = "unknown document"
+	}
+	if document.Chapter != "" {
+		source += fmt.Sprintf(", chapter %s", document.Chapter)
+	}
+	return fmt.Sprintf("%s, sentence %d", source, document.Position+1)
+}
+
+// Разбор списка через запятую
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Разбор списка целых чисел через запятую
+func parseIntList(value string) ([]int, error) {
+	var numbers []int
+	for _, item := range splitList(value) {
+		number, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
+
+// Печать отчета об оценке модели
+func printEvalReport(report trainer.EvalReport) {
+	fmt.Println("\n=== Evaluation Report ===")
+	fmt.Printf("Model: %s (order %d, smoothing %s)\n", report.Model, report.Order, report.Smoothing)
+	if report.Backoff != "" {
+		fmt.Printf("Backoff: %s\n", report.Backoff)
+	}
+	fmt.Printf("Held-out data: %s\n", report.Corpus)
+	fmt.Printf("Sentences: %d\n", report.Sentences)
+	fmt.Printf("Tokens: %d\n", report.Tokens)
+	fmt.Printf("OOV tokens: %d (%.2f%%)\n", report.OOVTokens, 100*report.OOVRate)
+	fmt.Printf("Cross-entropy: %.4f bits/token\n", report.CrossEntropy)
+	fmt.Printf("Perplexity: %.3f\n", report.Perplexity)
+
+	fmt.Println("\n=== N-gram Coverage ===")
+	for n := 1; n <= report.Order; n++ {
+		coverage, exists := report.Coverage[n]
+		if !exists {
+			continue
+		}
+		fmt.Printf("%d-grams: %d hits (%.2f%%)\n", n, report.Hits[n], 100*coverage)
+	}
+}
+
+// Дописываем строку в конец файла, создавая его при необходимости
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
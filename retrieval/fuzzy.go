@@ -0,0 +1,118 @@
+package retrieval
+
+import "sort"
+
+// Слово, найденное нечетким поиском
+type Match struct {
+	Word     string
+	Distance int // Расстояние Левенштейна до искомого слова
+}
+
+// BK-дерево слов для поиска по расстоянию редактирования: потомки узла
+// разложены по расстоянию до его слова, поэтому неподходящие ветви
+// отсекаются по неравенству треугольника
+type BKTree struct {
+	root *bkNode
+	size int
+}
+
+type bkNode struct {
+	word     string
+	children map[int]*bkNode
+}
+
+// Дерево из слов; порядок слов влияет только на форму дерева
+func NewBKTree(words []string) *BKTree {
+	tree := &BKTree{}
+	for _, word := range words {
+		tree.Add(word)
+	}
+	return tree
+}
+
+// Число слов в дереве
+func (t *BKTree) Len() int {
+	return t.size
+}
+
+// Добавляем слово; повторы не добавляются
+func (t *BKTree) Add(word string) {
+	if t.root == nil {
+		t.root = &bkNode{word: word}
+		t.size++
+		return
+	}
+
+	node := t.root
+	for {
+		distance := Distance(word, node.word)
+		if distance == 0 {
+			return
+		}
+		child, exists := node.children[distance]
+		if !exists {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[distance] = &bkNode{word: word}
+			t.size++
+			return
+		}
+		node = child
+	}
+}
+
+// Слова не дальше maxDistance правок, по возрастанию расстояния, затем по алфавиту
+func (t *BKTree) Search(word string, maxDistance int) []Match {
+	var matches []Match
+	if t.root == nil {
+		return matches
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := Distance(word, node.word)
+		if distance <= maxDistance {
+			matches = append(matches, Match{Word: node.word, Distance: distance})
+		}
+		for edge, child := range node.children {
+			if edge >= distance-maxDistance && edge <= distance+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Word < matches[j].Word
+	})
+	return matches
+}
+
+// Расстояние Левенштейна по символам: число вставок, удалений и замен
+func Distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
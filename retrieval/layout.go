@@ -0,0 +1,51 @@
+package retrieval
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Клавиши английской раскладки QWERTY и русской ЙЦУКЕН в одном порядке
+const (
+	englishKeys = "qwertyuiop[]asdfghjkl;'zxcvbnm,.`QWERTYUIOP{}ASDFGHJKL:\"ZXCVBNM<>~"
+	russianKeys = "йцукенгшщзхъфывапролджэячсмитьбюёЙЦУКЕНГШЩЗХЪФЫВАПРОЛДЖЭЯЧСМИТЬБЮЁ"
+)
+
+// Соответствие клавиш в обе стороны
+var (
+	englishToRussian = layoutMap(englishKeys, russianKeys)
+	russianToEnglish = layoutMap(russianKeys, englishKeys)
+)
+
+// Таблица замены символов одной раскладки символами другой
+func layoutMap(from, to string) map[rune]rune {
+	source, target := []rune(from), []rune(to)
+	mapping := make(map[rune]rune, len(source))
+	for i, r := range source {
+		mapping[r] = target[i]
+	}
+	return mapping
+}
+
+// Текст, набранный не в той раскладке: латиница переводится в кириллицу
+// («ghbdtn» → «привет»), иначе кириллица в латиницу. Символы без пары на
+// другой раскладке остаются как есть
+func SwitchLayout(text string) string {
+	mapping := russianToEnglish
+	for _, r := range text {
+		if unicode.Is(unicode.Latin, r) {
+			mapping = englishToRussian
+			break
+		}
+	}
+
+	var result strings.Builder
+	for _, r := range text {
+		if switched, exists := mapping[r]; exists {
+			result.WriteRune(switched)
+		} else {
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,28 @@
+package retrieval
+
+import "testing"
+
+// Перевод текста между раскладками в обе стороны
+func TestSwitchLayout(t *testing.T) {
+	cases := map[string]string{
+		"ghbdtn":        "привет",
+		"руддщ":         "hello",
+		"Vfhrjdf":       "Маркова",
+		"wtgm vfhrjdf?": "цепь маркова?",
+		"ntrcn 42":      "текст 42",
+	}
+	for input, expected := range cases {
+		if got := SwitchLayout(input); got != expected {
+			t.Errorf("SwitchLayout(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+// Двойное переключение слова возвращает исходное слово
+func TestSwitchLayoutRoundTrip(t *testing.T) {
+	for _, word := range []string{"вероятность", "марковским", "ёлка", "ЦЕПЬ"} {
+		if got := SwitchLayout(SwitchLayout(word)); got != word {
+			t.Errorf("switching %q twice gave %q", word, got)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package retrieval
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Разобранный поисковый запрос
+//
+// Синтаксис:
+//
+//	цепь маркова          — оба слова (AND подразумевается)
+//	цепь OR граф          — любое из слов
+//	цепь NOT граф, -граф  — исключение
+//	"цепь маркова"        — фраза
+//	"цепь маркова"~3      — слова в окне из 3 позиций
+//	марков*               — все слова с префиксом
+//	document:a chapter:2  — фильтры по документу и главе
+//	(a OR b) AND c        — группировка
+type Expr struct {
+	root node
+	text string
+}
+
+// Узел дерева запроса: множество предложений и слова для ранжирования
+type node interface {
+	eval(ix *Index) []int
+	words(ix *Index) []string
+}
+
+// Слово или префикс со звездочкой
+type termNode struct {
+	word   string
+	prefix bool
+}
+
+// Фраза или ограничение близости
+type phraseNode struct {
+	terms  []string
+	window int // 0 — слова подряд
+}
+
+// Фильтр по полю документа
+type fieldNode struct {
+	field string
+	value string
+}
+
+type andNode struct{ children []node }
+type orNode struct{ children []node }
+type notNode struct{ child node }
+
+// Поля, по которым можно фильтровать
+const (
+	FieldDocument = "document"
+	FieldChapter  = "chapter"
+)
+
+// Лексема запроса
+type queryToken struct {
+	kind  string // word, phrase, lparen, rparen
+	value string
+}
+
+// Разбор текста запроса
+func ParseQuery(text string) (Expr, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return Expr{}, err
+	}
+	if len(tokens) == 0 {
+		return Expr{}, fmt.Errorf("empty query")
+	}
+
+	parser := &queryParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return Expr{}, err
+	}
+	if parser.pos < len(tokens) {
+		return Expr{}, fmt.Errorf("unexpected %q at position %d", tokens[parser.pos].value, parser.pos+1)
+	}
+	return Expr{root: root, text: text}, nil
+}
+
+// Текст запроса
+func (e Expr) String() string {
+	return e.text
+}
+
+// Поиск по разобранному запросу с ранжированием BM25
+func (ix *Index) Find(expr Expr, limit int) []Result {
+	if expr.root == nil {
+		return nil
+	}
+	return ix.Rank(expr.root.eval(ix), uniqueWords(expr.root.words(ix)), limit)
+}
+
+// Разбиение запроса на слова, фразы и скобки
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: "lparen", value: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: "rparen", value: ")"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			phrase := string(runes[i+1 : end])
+			i = end + 1
+
+			// Необязательное окно близости: "..."~N
+			if i < len(runes) && runes[i] == '~' {
+				start := i
+				i++
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+				phrase += string(runes[start:i])
+			}
+			tokens = append(tokens, queryToken{kind: "phrase", value: phrase})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				// Значение поля может быть в кавычках: document:"глава 1"
+				if runes[i] == '"' && i > start && runes[i-1] == ':' {
+					end := i + 1
+					for end < len(runes) && runes[end] != '"' {
+						end++
+					}
+					if end == len(runes) {
+						return nil, fmt.Errorf("unterminated quote")
+					}
+					i = end + 1
+					continue
+				}
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: "word", value: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+// Рекурсивный спуск: OR связывает слабее AND, NOT — сильнее всего
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *queryParser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []node{left}
+	for token := p.peek(); token != nil && token.kind == "word" && token.value == "OR"; token = p.peek() {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return orNode{children}, nil
+}
+
+func (p *queryParser) parseAnd() (node, error) {
+	var children []node
+	for {
+		token := p.peek()
+		if token == nil || token.kind == "rparen" || (token.kind == "word" && token.value == "OR") {
+			break
+		}
+		if token.kind == "word" && token.value == "AND" {
+			p.pos++
+			continue
+		}
+
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	switch len(children) {
+	case 0:
+		if token := p.peek(); token != nil {
+			return nil, fmt.Errorf("expected a term before %q", token.value)
+		}
+		return nil, fmt.Errorf("expected a term at the end of the query")
+	case 1:
+		return children[0], nil
+	default:
+		return andNode{children}, nil
+	}
+}
+
+func (p *queryParser) parseNot() (node, error) {
+	token := p.peek()
+	if token.kind == "word" && token.value == "NOT" {
+		p.pos++
+		if p.peek() == nil {
+			return nil, fmt.Errorf("expected a term after NOT")
+		}
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	if token.kind == "word" && len(token.value) > 1 && strings.HasPrefix(token.value, "-") {
+		token.value = token.value[1:]
+		child, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (node, error) {
+	token := p.peek()
+	p.pos++
+
+	switch token.kind {
+	case "lparen":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing == nil || closing.kind != "rparen" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+
+	case "rparen":
+		return nil, fmt.Errorf("unexpected )")
+
+	case "phrase":
+		return parsePhrase(token.value)
+
+	default:
+		return parseWord(token.value)
+	}
+}
+
+// Фраза с необязательным окном близости
+func parsePhrase(value string) (node, error) {
+	window := 0
+	if i := strings.LastIndex(value, "~"); i >= 0 {
+		if i == len(value)-1 {
+			return nil, fmt.Errorf("proximity window after ~ is missing")
+		}
+		n, err := strconv.Atoi(value[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid proximity window %q", value[i+1:])
+		}
+		window = n
+		value = value[:i]
+	}
+
+	words := queryWords(value)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty phrase")
+	}
+	if len(words) == 1 && window == 0 {
+		return termNode{word: words[0]}, nil
+	}
+	return phraseNode{terms: words, window: window}, nil
+}
+
+// Слово, префикс или фильтр по полю
+func parseWord(value string) (node, error) {
+	if field, fieldValue, found := strings.Cut(value, ":"); found && field != "" {
+		switch strings.ToLower(field) {
+		case FieldDocument, "doc":
+			field = FieldDocument
+		case FieldChapter:
+			field = FieldChapter
+		default:
+			return nil, fmt.Errorf("unknown field %q (expected %q or %q)", field, FieldDocument, FieldChapter)
+		}
+		fieldValue = strings.ToLower(strings.Trim(fieldValue, `"`))
+		if fieldValue == "" {
+			return nil, fmt.Errorf("empty value for field %q", field)
+		}
+		return fieldNode{field: field, value: fieldValue}, nil
+	}
+
+	prefix := strings.HasSuffix(value, "*")
+	words := queryWords(strings.TrimSuffix(value, "*"))
+	if len(words) != 1 {
+		return nil, fmt.Errorf("invalid term %q", value)
+	}
+	return termNode{word: words[0], prefix: prefix}, nil
+}
+
+// Слова запроса в нижнем регистре, без знаков препинания
+func queryWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+func (n termNode) eval(ix *Index) []int {
+	var sets [][]int
+	for _, word := range n.words(ix) {
+		sets = append(sets, ix.Match(word))
+	}
+	return Union(sets...)
+}
+
+func (n termNode) words(ix *Index) []string {
+	if n.prefix {
+		return ix.Expand(n.word)
+	}
+	return []string{n.word}
+}
+
+func (n phraseNode) eval(ix *Index) []int {
+	if n.window > 0 {
+		return ix.Near(n.terms, n.window)
+	}
+	return ix.Phrase(n.terms)
+}
+
+func (n phraseNode) words(ix *Index) []string {
+	return n.terms
+}
+
+func (n fieldNode) eval(ix *Index) []int {
+	var docs []int
+	for doc, document := range ix.Documents {
+		value := document.Source
+		if n.field == FieldChapter {
+			value = document.Chapter
+		}
+		if strings.ToLower(value) == n.value {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+func (n fieldNode) words(ix *Index) []string {
+	return nil
+}
+
+func (n andNode) eval(ix *Index) []int {
+	var positive [][]int
+	var negative [][]int
+	for _, child := range n.children {
+		if not, ok := child.(notNode); ok {
+			negative = append(negative, not.child.eval(ix))
+		} else {
+			positive = append(positive, child.eval(ix))
+		}
+	}
+
+	var result []int
+	if len(positive) > 0 {
+		result = Intersect(positive...)
+	} else {
+		result = ix.all()
+	}
+	for _, excluded := range negative {
+		result = Difference(result, excluded)
+	}
+	return result
+}
+
+func (n andNode) words(ix *Index) []string {
+	var words []string
+	for _, child := range n.children {
+		words = append(words, child.words(ix)...)
+	}
+	return words
+}
+
+func (n orNode) eval(ix *Index) []int {
+	var sets [][]int
+	for _, child := range n.children {
+		sets = append(sets, child.eval(ix))
+	}
+	return Union(sets...)
+}
+
+func (n orNode) words(ix *Index) []string {
+	var words []string
+	for _, child := range n.children {
+		words = append(words, child.words(ix)...)
+	}
+	return words
+}
+
+func (n notNode) eval(ix *Index) []int {
+	return Difference(ix.all(), n.child.eval(ix))
+}
+
+// Исключенные слова не участвуют в ранжировании
+func (n notNode) words(ix *Index) []string {
+	return nil
+}
+
+// Все предложения индекса
+func (ix *Index) all() []int {
+	docs := make([]int, len(ix.Documents))
+	for i := range docs {
+		docs[i] = i
+	}
+	return docs
+}
+
+// Слова индекса с заданным префиксом в алфавитном порядке
+func (ix *Index) Expand(prefix string) []string {
+	var words []string
+	for word := range ix.Postings {
+		if strings.HasPrefix(word, prefix) {
+			words = append(words, word)
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+// Разность отсортированных списков номеров
+func Difference(set, excluded []int) []int {
+	var result []int
+	j := 0
+	for _, doc := range set {
+		for j < len(excluded) && excluded[j] < doc {
+			j++
+		}
+		if j < len(excluded) && excluded[j] == doc {
+			continue
+		}
+		result = append(result, doc)
+	}
+	return result
+}
+
+// Выделение слов в тексте предложения: open и close ставятся вокруг
+// каждого слова, совпавшего с одним из words
+func Highlight(text string, words []string, open, close string) string {
+	if len(words) == 0 {
+		return text
+	}
+	highlighted := make(map[string]bool)
+	for _, word := range words {
+		highlighted[strings.ToLower(word)] = true
+	}
+
+	var builder strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			builder.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		word := string(runes[start:i])
+		if highlighted[strings.ToLower(word)] {
+			builder.WriteString(open + word + close)
+		} else {
+			builder.WriteString(word)
+		}
+	}
+	return builder.String()
+}
+
+// Символ слова, как его понимает токенизатор
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '-'
+}
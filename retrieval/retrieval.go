@@ -0,0 +1,454 @@
+package retrieval
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Параметры ранжирования BM25
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Предложение в хранилище документов
+type Document struct {
+	Text     string `json:"text"`              // Исходное предложение
+	Source   string `json:"source,omitempty"`  // Документ корпуса, из которого взято предложение
+	Chapter  string `json:"chapter,omitempty"` // Глава внутри документа
+	Position int    `json:"position"`          // Номер предложения в документе
+	Length   int    `json:"length"`            // Число проиндексированных слов
+}
+
+// Вхождения слова в предложение; частота слова — число позиций
+type Posting struct {
+	Doc       int   `json:"doc"`
+	Positions []int `json:"pos"`
+}
+
+// Поисковый индекс: хранилище предложений и списки вхождений слов
+type Index struct {
+	Documents []Document           `json:"documents"` // Номер предложения -> предложение
+	Postings  map[string][]Posting `json:"postings"`  // Слово -> вхождения по возрастанию номера
+
+	totalLength int               // Суммарная длина предложений для BM25
+	lengthReady bool              // Посчитана ли суммарная длина
+	cursors     map[string]cursor // Текущая позиция и глава по документам корпуса
+}
+
+// Состояние документа корпуса при добавлении предложений
+type cursor struct {
+	position int
+	chapter  string
+}
+
+// Ограничение близости: все слова в окне из Window позиций
+type Proximity struct {
+	Terms  []string
+	Window int
+}
+
+// Поисковый запрос. Фразы и ограничения близости обязательны; если их нет,
+// предложение должно содержать хотя бы одно из слов Terms. Ранжирование —
+// BM25 по всем словам запроса
+type Query struct {
+	Terms   []string
+	Phrases [][]string
+	Near    []Proximity
+}
+
+// Найденное предложение
+type Result struct {
+	Doc      int
+	Score    float64
+	Document Document
+	Matched  []string // Слова запроса, встретившиеся в предложении
+}
+
+// Создание пустого индекса
+func New() *Index {
+	return &Index{
+		Postings: make(map[string][]Posting),
+	}
+}
+
+// Добавляем предложение в индекс. Токены <start> и <end> и знаки препинания
+// не индексируются, но знаки препинания занимают позиции, поэтому фраза не
+// совпадет через запятую. Заголовок "Глава N" открывает новую главу документа
+func (ix *Index) Add(text, source string, tokens []string) int {
+	if ix.Postings == nil {
+		ix.Postings = make(map[string][]Posting)
+	}
+	state := ix.cursor(source)
+
+	var words []string
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" {
+			words = append(words, token)
+		}
+	}
+	if chapter := chapterHeading(words); chapter != "" {
+		state.chapter = chapter
+	}
+
+	doc := len(ix.Documents)
+	document := Document{
+		Text:     text,
+		Source:   source,
+		Chapter:  state.chapter,
+		Position: state.position,
+	}
+
+	positions := make(map[string][]int)
+	var order []string
+	for position, word := range words {
+		if isPunctuation(word) {
+			continue
+		}
+		if positions[word] == nil {
+			order = append(order, word)
+		}
+		positions[word] = append(positions[word], position)
+		document.Length++
+	}
+	for _, word := range order {
+		ix.Postings[word] = append(ix.Postings[word], Posting{Doc: doc, Positions: positions[word]})
+	}
+
+	ix.Documents = append(ix.Documents, document)
+	if ix.lengthReady {
+		ix.totalLength += document.Length
+	}
+	state.position++
+	ix.cursors[source] = state
+
+	return doc
+}
+
+// Позиция и глава, с которых продолжается документ корпуса
+func (ix *Index) cursor(source string) cursor {
+	if ix.cursors == nil {
+		ix.cursors = make(map[string]cursor)
+		for _, document := range ix.Documents {
+			ix.cursors[document.Source] = cursor{position: document.Position + 1, chapter: document.Chapter}
+		}
+	}
+	return ix.cursors[source]
+}
+
+// Присоединяем другой индекс; его предложения получают номера после наших
+func (ix *Index) Merge(other *Index) {
+	if other == nil {
+		return
+	}
+	if ix.Postings == nil {
+		ix.Postings = make(map[string][]Posting)
+	}
+
+	offset := len(ix.Documents)
+	ix.Documents = append(ix.Documents, other.Documents...)
+	for word, postings := range other.Postings {
+		for _, posting := range postings {
+			ix.Postings[word] = append(ix.Postings[word], Posting{Doc: posting.Doc + offset, Positions: posting.Positions})
+		}
+	}
+
+	ix.lengthReady = false
+	ix.cursors = nil
+}
+
+// Число предложений в индексе
+func (ix *Index) Len() int {
+	return len(ix.Documents)
+}
+
+// Число разных слов в индексе
+func (ix *Index) Terms() int {
+	return len(ix.Postings)
+}
+
+// Позиции слова в предложении
+func (ix *Index) positions(word string, doc int) []int {
+	postings := ix.Postings[word]
+	i := sort.Search(len(postings), func(i int) bool { return postings[i].Doc >= doc })
+	if i < len(postings) && postings[i].Doc == doc {
+		return postings[i].Positions
+	}
+	return nil
+}
+
+// Частота слова в предложении
+func (ix *Index) Frequency(word string, doc int) int {
+	return len(ix.positions(word, doc))
+}
+
+// Средняя длина предложения
+func (ix *Index) averageLength() float64 {
+	if !ix.lengthReady {
+		ix.totalLength = 0
+		for _, document := range ix.Documents {
+			ix.totalLength += document.Length
+		}
+		ix.lengthReady = true
+	}
+	if len(ix.Documents) == 0 {
+		return 0
+	}
+	return float64(ix.totalLength) / float64(len(ix.Documents))
+}
+
+// Обратная частота слова по BM25: ln(1 + (N - df + 0.5) / (df + 0.5))
+func (ix *Index) IDF(word string) float64 {
+	df := float64(len(ix.Postings[word]))
+	n := float64(len(ix.Documents))
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// Оценка BM25 предложения по словам запроса
+func (ix *Index) Score(doc int, words []string) float64 {
+	averageLength := ix.averageLength()
+	length := float64(ix.Documents[doc].Length)
+
+	score := 0.0
+	for _, word := range uniqueWords(words) {
+		tf := float64(ix.Frequency(word, doc))
+		if tf == 0 {
+			continue
+		}
+		norm := 1 - bm25B
+		if averageLength > 0 {
+			norm += bm25B * length / averageLength
+		}
+		score += ix.IDF(word) * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+	}
+	return score
+}
+
+// Предложения, содержащие слово
+func (ix *Index) Match(word string) []int {
+	postings := ix.Postings[word]
+	docs := make([]int, len(postings))
+	for i, posting := range postings {
+		docs[i] = posting.Doc
+	}
+	return docs
+}
+
+// Предложения, в которых слова фразы идут подряд
+func (ix *Index) Phrase(phrase []string) []int {
+	if len(phrase) == 0 {
+		return nil
+	}
+
+	var docs []int
+	for _, posting := range ix.Postings[phrase[0]] {
+		for _, start := range posting.Positions {
+			if ix.phraseAt(posting.Doc, phrase, start) {
+				docs = append(docs, posting.Doc)
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// Стоит ли фраза в предложении с позиции start
+func (ix *Index) phraseAt(doc int, phrase []string, start int) bool {
+	for offset, word := range phrase[1:] {
+		if !containsPosition(ix.positions(word, doc), start+offset+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// Предложения, в которых все слова встречаются в окне из window позиций
+func (ix *Index) Near(words []string, window int) []int {
+	words = uniqueWords(words)
+	if len(words) == 0 {
+		return nil
+	}
+
+	var docs []int
+	for _, doc := range ix.Match(words[0]) {
+		lists := make([][]int, len(words))
+		found := true
+		for i, word := range words {
+			lists[i] = ix.positions(word, doc)
+			if len(lists[i]) == 0 {
+				found = false
+				break
+			}
+		}
+		if found && withinWindow(lists, window) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// Есть ли по одной позиции из каждого списка с разбросом не больше window:
+// двигаем указатель минимальной позиции, пока один из списков не кончится
+func withinWindow(lists [][]int, window int) bool {
+	pointers := make([]int, len(lists))
+	for {
+		low, high := math.MaxInt, math.MinInt
+		lowest := 0
+		for i, list := range lists {
+			position := list[pointers[i]]
+			if position < low {
+				low = position
+				lowest = i
+			}
+			high = max(high, position)
+		}
+		if high-low <= window {
+			return true
+		}
+
+		pointers[lowest]++
+		if pointers[lowest] == len(lists[lowest]) {
+			return false
+		}
+	}
+}
+
+// Поиск с ранжированием BM25; при равной оценке раньше идет предложение
+// с меньшим номером, поэтому порядок результатов детерминирован
+func (ix *Index) Search(query Query, limit int) []Result {
+	var candidates []int
+	constrained := len(query.Phrases) > 0 || len(query.Near) > 0
+	if constrained {
+		var sets [][]int
+		for _, phrase := range query.Phrases {
+			sets = append(sets, ix.Phrase(phrase))
+		}
+		for _, near := range query.Near {
+			sets = append(sets, ix.Near(near.Terms, near.Window))
+		}
+		candidates = Intersect(sets...)
+	} else {
+		var sets [][]int
+		for _, word := range query.Terms {
+			sets = append(sets, ix.Match(word))
+		}
+		candidates = Union(sets...)
+	}
+
+	words := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		words = append(words, phrase...)
+	}
+	for _, near := range query.Near {
+		words = append(words, near.Terms...)
+	}
+
+	return ix.Rank(candidates, words, limit)
+}
+
+// Ранжирование предложений по BM25 с устойчивым порядком
+func (ix *Index) Rank(docs []int, words []string, limit int) []Result {
+	results := make([]Result, len(docs))
+	for i, doc := range docs {
+		results[i] = Result{Doc: doc, Score: ix.Score(doc, words), Document: ix.Documents[doc]}
+		for _, word := range uniqueWords(words) {
+			if ix.Frequency(word, doc) > 0 {
+				results[i].Matched = append(results[i].Matched, word)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Doc < results[j].Doc
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Пересечение отсортированных списков номеров
+func Intersect(sets ...[]int) []int {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	result := sets[0]
+	for _, set := range sets[1:] {
+		var next []int
+		i, j := 0, 0
+		for i < len(result) && j < len(set) {
+			switch {
+			case result[i] < set[j]:
+				i++
+			case result[i] > set[j]:
+				j++
+			default:
+				next = append(next, result[i])
+				i++
+				j++
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// Объединение отсортированных списков номеров
+func Union(sets ...[]int) []int {
+	seen := make(map[int]bool)
+	var result []int
+	for _, set := range sets {
+		for _, doc := range set {
+			if !seen[doc] {
+				seen[doc] = true
+				result = append(result, doc)
+			}
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+// Номер главы, если предложение — заголовок вида "Глава 3" или "Chapter IV"
+func chapterHeading(words []string) string {
+	if len(words) < 2 {
+		return ""
+	}
+	if words[0] != "глава" && words[0] != "chapter" {
+		return ""
+	}
+	if strings.Trim(words[1], "0123456789") != "" && strings.Trim(words[1], "ivxlcdm") != "" {
+		return ""
+	}
+	return words[1]
+}
+
+// Есть ли позиция в отсортированном списке
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+// Слова без повторов в порядке первого появления
+func uniqueWords(words []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			unique = append(unique, word)
+		}
+	}
+	return unique
+}
+
+// Проверяем, является ли токен знаком препинания
+func isPunctuation(token string) bool {
+	return len(token) == 1 && strings.Contains(",.!?;:", token)
+}
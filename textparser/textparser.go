@@ -264,6 +264,15 @@ func (p *TextParser) SaveParagraphs(paragraphs []string, filename string) error
 	return writer.Flush()
 }
 
+// Файлы, в которые сохраняются результаты парсинга
+func (p *TextParser) ParsedFiles(baseFilename string) []string {
+	return []string{
+		baseFilename + "_cleaned.txt",
+		baseFilename + "_sentences.txt",
+		baseFilename + "_paragraphs.txt",
+	}
+}
+
 // Загрузка ранее спарсенных данных из файлов
 func (p *TextParser) LoadParsedData(baseFilename string) (*ParseResult, error) {
 	cleanedBytes, err := os.ReadFile(baseFilename + "_cleaned.txt")
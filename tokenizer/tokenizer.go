@@ -15,8 +15,8 @@ type Tokenizer struct {
 
 // Настройки токенизатора
 type Config struct {
-	KeepPunctuation bool // Сохранять знаки препинания как отдельные токены
-	ToLowerCase     bool // Приводить к нижнему регистру
+	KeepPunctuation bool `json:"keep_punctuation"` // Сохранять знаки препинания как отдельные токены
+	ToLowerCase     bool `json:"to_lower_case"`    // Приводить к нижнему регистру
 }
 
 // Создание нового экземпляря токенизатора
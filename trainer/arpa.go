@@ -0,0 +1,448 @@
+package trainer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Логарифм, которым в ARPA обозначается нулевая вероятность
+const arpaLogZero = -99
+
+// Вероятности и веса отката модели, импортированной из ARPA (log10)
+type ARPATables struct {
+	Probabilities map[string]map[string]float64 `json:"probabilities"` // prefix -> {suffix -> log10 P}
+	Backoffs      map[string]float64            `json:"backoffs"`      // Контекст -> log10 веса отката
+}
+
+// N-грамма ARPA: вероятность и вес отката, если N-грамма служит контекстом
+type arpaEntry struct {
+	tokens     []string
+	logProb    float64
+	backoff    float64
+	hasBackoff bool
+}
+
+// Заголовок раздела N-грамм: \N-grams:
+var arpaSection = regexp.MustCompile(`^\\(\d+)-grams:$`)
+
+// Экспорт модели в текстовый формат ARPA
+func (mc *MarkovChain) ExportARPA(path string) error {
+	var buffer bytes.Buffer
+	if err := mc.WriteARPA(&buffer); err != nil {
+		return err
+	}
+
+	err := writeFileAtomic(path, buffer.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write ARPA file: %w", err)
+	}
+
+	fmt.Printf("ARPA model saved to %s\n", path)
+	return nil
+}
+
+// Запись модели в формате ARPA. Для каждой N-граммы цепи пишется вероятность
+// модели, для каждого контекста — вес отката, при котором вероятности
+// продолжений контекста в сумме дают 1. Вероятности N-грамм цепи совпадают
+// с Probability; для Katz и сглаженных моделей совпадают и вероятности
+// невиданных продолжений известных контекстов
+//
+// Stupid backoff не задает нормированного распределения: цепь берет самый
+// длинный известный контекст, а Probability для оценки считает add-one,
+// поэтому такие модели в ARPA не экспортируются
+func (mc *MarkovChain) WriteARPA(w io.Writer) error {
+	if mc.Backoff == BackoffStupid {
+		return fmt.Errorf("models with %q backoff have no normalized probabilities and cannot be exported to ARPA, retrain with --backoff katz or --smoothing", BackoffStupid)
+	}
+
+	var orders [][]arpaEntry
+	if mc.ARPA != nil {
+		orders = mc.arpaEntriesFromTables()
+	} else {
+		orders = mc.arpaEntriesFromChain()
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, `\data\`)
+	for n, entries := range orders {
+		fmt.Fprintf(out, "ngram %d=%d\n", n+1, len(entries))
+	}
+
+	for n, entries := range orders {
+		fmt.Fprintf(out, "\n\\%d-grams:\n", n+1)
+		for _, entry := range entries {
+			words := make([]string, len(entry.tokens))
+			for i, token := range entry.tokens {
+				words[i] = toARPAToken(token)
+			}
+
+			fmt.Fprintf(out, "%s\t%s", formatLog10(entry.logProb), strings.Join(words, " "))
+			if entry.hasBackoff {
+				fmt.Fprintf(out, "\t%s", formatLog10(entry.backoff))
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	fmt.Fprintln(out, "\n\\end\\")
+
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("failed to write ARPA model: %w", err)
+	}
+	return nil
+}
+
+// N-граммы обученной цепи: вероятности берутся из Probability, промежуточные
+// N-граммы, нужные как контексты старших порядков, получают вероятность отката
+func (mc *MarkovChain) arpaEntriesFromChain() [][]arpaEntry {
+	probabilities := make([]map[string]map[string]float64, mc.Order)
+	seen := make([]map[string]map[string]bool, mc.Order)
+	for n := range probabilities {
+		probabilities[n] = make(map[string]map[string]float64)
+		seen[n] = make(map[string]map[string]bool)
+	}
+	add := func(tokens []string, isSeen bool) {
+		n := len(tokens) - 1
+		prefix := joinTokens(tokens[:n])
+		if seen[n][prefix] == nil {
+			seen[n][prefix] = make(map[string]bool)
+			probabilities[n][prefix] = make(map[string]float64)
+		}
+		seen[n][prefix][tokens[n]] = seen[n][prefix][tokens[n]] || isSeen
+	}
+
+	// Униграммы: весь словарь, <end> и <start>
+	add([]string{"<start>"}, false)
+	add([]string{"<end>"}, true)
+	for token := range mc.Vocab {
+		add([]string{token}, true)
+	}
+
+	for prefix, suffixes := range mc.Chain {
+		tokens := prefixTokens(prefix)
+		if len(tokens) == 0 {
+			continue
+		}
+		for suffix, count := range suffixes {
+			if count > 0 {
+				add(append(append([]string{}, tokens...), suffix), true)
+			}
+		}
+	}
+
+	// Каждый контекст должен присутствовать как N-грамма младшего порядка
+	for n := mc.Order - 1; n >= 1; n-- {
+		for prefix := range seen[n] {
+			add(prefixTokens(prefix), false)
+		}
+	}
+
+	backoffs := make(map[string]float64)
+	lookup := func(context []string, token string) float64 {
+		return arpaLookup(probabilities, backoffs, context, token)
+	}
+
+	for n := 0; n < mc.Order; n++ {
+		for prefix, suffixes := range seen[n] {
+			context := prefixTokens(prefix)
+			ordered := make([]string, 0, len(suffixes))
+			for suffix := range suffixes {
+				ordered = append(ordered, suffix)
+			}
+			sort.Strings(ordered)
+
+			// Вес отката: оставшаяся масса контекста, нормированная на массу
+			// младшего контекста, не занятую известными продолжениями
+			alpha := 1.0
+			if n > 0 {
+				seenMass, lowerMass := 0.0, 0.0
+				for _, suffix := range ordered {
+					if suffixes[suffix] {
+						seenMass += mc.Probability(context, suffix)
+						lowerMass += lookup(context[1:], suffix)
+					}
+				}
+				alpha = 0
+				if seenMass < 1 && lowerMass < 1 {
+					alpha = (1 - seenMass) / (1 - lowerMass)
+				}
+				backoffs[prefix] = alpha
+			}
+
+			for suffix, isSeen := range suffixes {
+				switch {
+				case suffix == "<start>":
+					probabilities[n][prefix][suffix] = 0
+				case isSeen:
+					probabilities[n][prefix][suffix] = mc.Probability(context, suffix)
+				default:
+					probabilities[n][prefix][suffix] = alpha * lookup(context[1:], suffix)
+				}
+			}
+		}
+	}
+
+	orders := make([][]arpaEntry, mc.Order)
+	for n := range orders {
+		for prefix, suffixes := range probabilities[n] {
+			for suffix, probability := range suffixes {
+				tokens := append(prefixTokens(prefix), suffix)
+				entry := arpaEntry{tokens: tokens, logProb: math.Log10(probability)}
+				if weight, isContext := backoffs[joinTokens(tokens)]; isContext {
+					entry.backoff = math.Log10(weight)
+					entry.hasBackoff = true
+				}
+				orders[n] = append(orders[n], entry)
+			}
+		}
+		sortARPAEntries(orders[n])
+	}
+	return orders
+}
+
+// Вероятность по построенным таблицам с откатом к младшим контекстам
+func arpaLookup(probabilities []map[string]map[string]float64, backoffs map[string]float64, context []string, token string) float64 {
+	weight := 1.0
+	for {
+		prefix := joinTokens(context)
+		if probability, exists := probabilities[len(context)][prefix][token]; exists {
+			return weight * probability
+		}
+		if len(context) == 0 {
+			return 0
+		}
+		if alpha, exists := backoffs[prefix]; exists {
+			weight *= alpha
+		}
+		context = context[1:]
+	}
+}
+
+// N-граммы импортированной модели переписываются без изменений
+func (mc *MarkovChain) arpaEntriesFromTables() [][]arpaEntry {
+	orders := make([][]arpaEntry, mc.Order)
+	for prefix, suffixes := range mc.ARPA.Probabilities {
+		tokens := prefixTokens(prefix)
+		for suffix, logProb := range suffixes {
+			entry := arpaEntry{tokens: append(append([]string{}, tokens...), suffix), logProb: logProb}
+			entry.backoff, entry.hasBackoff = mc.ARPA.Backoffs[joinTokens(entry.tokens)]
+			orders[len(tokens)] = append(orders[len(tokens)], entry)
+		}
+	}
+	for _, entries := range orders {
+		sortARPAEntries(entries)
+	}
+	return orders
+}
+
+// Импорт модели из файла ARPA. Счетчиков в ARPA нет, поэтому цепь хранит
+// только наличие N-грамм, а вероятности берутся из таблиц ARPA
+func ImportARPA(path string, config TrainConfig) (*MarkovChain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ARPA file: %w", err)
+	}
+	defer file.Close()
+
+	mc, err := ReadARPA(file, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ARPA file %s: %w", path, err)
+	}
+	if err := mc.RecordCorpus([]string{path}); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("ARPA model imported from %s (order: %d, vocabulary size: %d)\n", path, mc.Order, len(mc.Vocab))
+	return mc, nil
+}
+
+// Чтение модели в формате ARPA
+func ReadARPA(r io.Reader, config TrainConfig) (*MarkovChain, error) {
+	tables := &ARPATables{
+		Probabilities: make(map[string]map[string]float64),
+		Backoffs:      make(map[string]float64),
+	}
+	declared := make(map[int]int)
+	read := make(map[int]int)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	section := -1 // -1 — до \data\, 0 — раздел \data\, N — раздел N-грамм
+	line := 0
+	finished := false
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || finished {
+			continue
+		}
+
+		switch {
+		case text == `\data\`:
+			section = 0
+			continue
+		case text == `\end\`:
+			finished = true
+			continue
+		case section < 0:
+			continue
+		}
+		if match := arpaSection.FindStringSubmatch(text); match != nil {
+			section, _ = strconv.Atoi(match[1])
+			if _, exists := declared[section]; !exists {
+				return nil, fmt.Errorf("line %d: section %d-grams is not declared in \\data\\", line, section)
+			}
+			continue
+		}
+
+		if section == 0 {
+			var n, count int
+			if _, err := fmt.Sscanf(text, "ngram %d=%d", &n, &count); err != nil || n < 1 {
+				return nil, fmt.Errorf("line %d: invalid ngram count %q", line, text)
+			}
+			declared[n] = count
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != section+1 && len(fields) != section+2 {
+			return nil, fmt.Errorf("line %d: expected %d words in %d-gram entry, got %q", line, section, section, text)
+		}
+		logProb, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid probability %q", line, fields[0])
+		}
+
+		tokens := make([]string, section)
+		for i, word := range fields[1 : section+1] {
+			tokens[i] = fromARPAToken(word)
+		}
+		prefix := joinTokens(tokens[:section-1])
+		if tables.Probabilities[prefix] == nil {
+			tables.Probabilities[prefix] = make(map[string]float64)
+		}
+		tables.Probabilities[prefix][tokens[section-1]] = logProb
+
+		if len(fields) == section+2 {
+			backoff, err := strconv.ParseFloat(fields[section+1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid backoff weight %q", line, fields[section+1])
+			}
+			tables.Backoffs[joinTokens(tokens)] = backoff
+		}
+		read[section]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !finished {
+		return nil, fmt.Errorf("missing \\end\\ marker")
+	}
+	order := 0
+	for n, count := range declared {
+		if read[n] != count {
+			return nil, fmt.Errorf("%d-grams: declared %d entries, found %d", n, count, read[n])
+		}
+		order = max(order, n)
+	}
+	for n := 1; n <= order; n++ {
+		if _, exists := declared[n]; !exists {
+			return nil, fmt.Errorf("missing %d-grams section", n)
+		}
+	}
+	if order == 0 {
+		return nil, fmt.Errorf("no n-grams found")
+	}
+
+	config.Order = order
+	config.Backoff = BackoffARPA
+	config.Smoothing = ""
+	mc := NewMarkovTrainer(config)
+	mc.ARPA = tables
+
+	for prefix, suffixes := range tables.Probabilities {
+		for suffix, logProb := range suffixes {
+			if logProb <= arpaLogZero || suffix == "<start>" {
+				continue
+			}
+			if mc.Chain[prefix] == nil {
+				mc.Chain[prefix] = make(map[string]int)
+			}
+			mc.Chain[prefix][suffix] = 1
+			if prefix == joinTokens(nil) && suffix != "<end>" {
+				mc.Vocab[suffix] = 1
+			}
+		}
+	}
+	mc.calculateSums()
+	mc.RecomputeStats()
+	mc.Meta.TrainedAt = trainingTime()
+
+	return mc, nil
+}
+
+// Вероятность токена по таблицам ARPA: log10 P(w|h) или вес отката h
+// плюс вероятность по более короткому контексту
+func (mc *MarkovChain) arpaProbability(context []string, token string) float64 {
+	weight := 0.0
+	for {
+		prefix := joinTokens(context)
+		if logProb, exists := mc.ARPA.Probabilities[prefix][token]; exists {
+			if logProb <= arpaLogZero {
+				return 0
+			}
+			return math.Pow(10, weight+logProb)
+		}
+		if len(context) == 0 {
+			return 0
+		}
+		weight += mc.ARPA.Backoffs[prefix]
+		context = context[1:]
+	}
+}
+
+// Сортировка N-грамм для воспроизводимого вывода
+func sortARPAEntries(entries []arpaEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Join(entries[i].tokens, " ") < strings.Join(entries[j].tokens, " ")
+	})
+}
+
+// Логарифм в записи ARPA; нулевая вероятность записывается как -99
+func formatLog10(value float64) string {
+	if math.IsInf(value, -1) || math.IsNaN(value) || value < arpaLogZero {
+		value = arpaLogZero
+	}
+	return strconv.FormatFloat(value, 'f', 7, 64)
+}
+
+// Служебные токены цепи и их обозначения в ARPA
+func toARPAToken(token string) string {
+	switch token {
+	case "<start>":
+		return "<s>"
+	case "<end>":
+		return "</s>"
+	default:
+		return token
+	}
+}
+
+func fromARPAToken(word string) string {
+	switch word {
+	case "<s>":
+		return "<start>"
+	case "</s>":
+		return "<end>"
+	default:
+		return word
+	}
+}
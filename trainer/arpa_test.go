@@ -0,0 +1,53 @@
+package trainer
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// Экспорт в ARPA и обратный импорт сохраняют вероятности модели для
+// всех продолжений известных контекстов
+func TestARPARoundTrip(t *testing.T) {
+	for name, config := range normalizedConfigs {
+		t.Run(name, func(t *testing.T) {
+			mc := trainTestModel(t, config)
+
+			var buffer bytes.Buffer
+			if err := mc.WriteARPA(&buffer); err != nil {
+				t.Fatalf("export failed: %v", err)
+			}
+			imported, err := ReadARPA(&buffer, TrainConfig{})
+			if err != nil {
+				t.Fatalf("import failed: %v", err)
+			}
+
+			for prefix := range mc.Chain {
+				context := prefixTokens(prefix)
+				if len(context) != mc.Order-1 {
+					continue
+				}
+				tokens := []string{"<end>"}
+				for token := range mc.Vocab {
+					tokens = append(tokens, token)
+				}
+				for _, token := range tokens {
+					want := math.Log10(mc.Probability(context, token))
+					got := math.Log10(imported.Probability(context, token))
+					if math.Abs(want-got) > 1e-5 {
+						t.Fatalf("log10 P(%s | %v): model %.7f, after ARPA round trip %.7f", token, context, want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Модели со stupid backoff в ARPA не экспортируются
+func TestARPARejectsStupidBackoff(t *testing.T) {
+	mc := trainTestModel(t, TrainConfig{Order: 3, Backoff: BackoffStupid})
+	var buffer bytes.Buffer
+	if err := mc.WriteARPA(&buffer); err == nil {
+		t.Fatal("expected stupid backoff export to fail")
+	}
+}
@@ -0,0 +1,104 @@
+package trainer
+
+import (
+	"fmt"
+)
+
+// Настройки автоматического подбора модели
+type TuneConfig struct {
+	Base      TrainConfig // Общие настройки обучения
+	Orders    []int       // Порядки-кандидаты
+	MinCounts []int       // Пороги прореживания-кандидаты
+}
+
+// Результат одного кандидата на валидационной части
+type TuneCandidate struct {
+	Order       int        `json:"order"`
+	MinCount    int        `json:"min_count"`
+	Prefixes    int        `json:"prefixes"`
+	Transitions int        `json:"transitions"`
+	Validation  EvalReport `json:"validation"`
+}
+
+// Отчет о подборе: все кандидаты, лучший из них и его оценка на тестовой части
+type TuneReport struct {
+	Split      SplitConfig     `json:"split"`
+	Candidates []TuneCandidate `json:"candidates"`
+	Best       int             `json:"best"`
+	Test       *EvalReport     `json:"test,omitempty"`
+}
+
+// Обучаем все сочетания порядков и порогов на обучающей части, выбираем
+// кандидата с наименьшей перплексией на валидационной части (при равенстве —
+// меньшую модель) и оцениваем его на тестовой части
+func AutoTune(split Split, config TuneConfig) (*MarkovChain, TuneReport, error) {
+	report := TuneReport{Best: -1}
+
+	train := Sentences(split.Train)
+	validation := Sentences(split.Validation)
+	if len(train) == 0 {
+		return nil, report, fmt.Errorf("training split is empty")
+	}
+	if len(validation) == 0 {
+		return nil, report, fmt.Errorf("validation split is empty")
+	}
+
+	minCounts := config.MinCounts
+	if len(minCounts) == 0 {
+		minCounts = []int{config.Base.MinFrequency}
+	}
+
+	var best *MarkovChain
+	for _, order := range config.Orders {
+		for _, minCount := range minCounts {
+			trainConfig := config.Base
+			trainConfig.Order = order
+			trainConfig.MinFrequency = minCount
+
+			candidate := NewMarkovTrainer(trainConfig)
+			if err := candidate.TrainDocuments(split.Train); err != nil {
+				return nil, report, fmt.Errorf("failed to train order %d, min count %d: %w", order, minCount, err)
+			}
+
+			evaluation := candidate.Evaluate(validation)
+			if evaluation.Tokens == evaluation.OOVTokens {
+				return nil, report, fmt.Errorf("validation split has no in-vocabulary tokens")
+			}
+
+			result := TuneCandidate{
+				Order:      order,
+				MinCount:   minCount,
+				Prefixes:   len(candidate.Chain),
+				Validation: evaluation,
+			}
+			for _, suffixes := range candidate.Chain {
+				result.Transitions += len(suffixes)
+			}
+			report.Candidates = append(report.Candidates, result)
+
+			if report.Best < 0 || betterCandidate(result, report.Candidates[report.Best]) {
+				report.Best = len(report.Candidates) - 1
+				best = candidate
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, report, fmt.Errorf("no candidate orders to try")
+	}
+
+	if test := Sentences(split.Test); len(test) > 0 {
+		evaluation := best.Evaluate(test)
+		report.Test = &evaluation
+	}
+
+	return best, report, nil
+}
+
+// Сравнение кандидатов: меньшая перплексия, затем меньшее число переходов
+func betterCandidate(a, b TuneCandidate) bool {
+	if a.Validation.Perplexity != b.Validation.Perplexity {
+		return a.Validation.Perplexity < b.Validation.Perplexity
+	}
+	return a.Transitions < b.Transitions
+}
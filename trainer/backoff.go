@@ -0,0 +1,264 @@
+package trainer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Стратегии отката к более коротким контекстам
+const (
+	BackoffNone   = ""       // Только префиксы длины Order-1
+	BackoffStupid = "stupid" // Stupid backoff: берем самый длинный известный контекст
+	BackoffKatz   = "katz"   // Katz backoff с дисконтированием Гуда-Тьюринга
+	BackoffARPA   = "arpa"   // Вероятности и веса отката из импортированной ARPA-модели
+)
+
+// Семантика порядка для цепей, хранящих все порядки от 1 до N
+const OrderSemanticsVariable = "variable"
+
+// Максимальный счетчик, для которого применяется дисконт Гуда-Тьюринга
+const katzMaxCount = 5
+
+// Точность сравнения масс вероятности с единицей
+const katzEpsilon = 1e-12
+
+// Проверка названия стратегии отката
+func validBackoff(backoff string) error {
+	switch backoff {
+	case BackoffNone, BackoffStupid, BackoffKatz, BackoffARPA:
+		return nil
+	default:
+		return fmt.Errorf("unknown backoff %q (expected %q, %q or %q for models imported from ARPA)", backoff, BackoffStupid, BackoffKatz, BackoffARPA)
+	}
+}
+
+// Хранит ли цепь все порядки от 1 до N
+func (mc *MarkovChain) IsVariableOrder() bool {
+	return mc.Backoff != BackoffNone || mc.Smoothing.needsLowerOrders()
+}
+
+// Добавляем в цепь N-граммы всех порядков от 1 до N
+func (mc *MarkovChain) processSentenceAllOrders(sentence []string) {
+	for n := 1; n <= mc.Order; n++ {
+		for i := 0; i <= len(sentence)-n; i++ {
+			suffix := sentence[i+n-1]
+			if suffix == "<start>" {
+				continue
+			}
+			prefix := joinTokens(sentence[i : i+n-1])
+
+			if mc.Chain[prefix] == nil {
+				mc.Chain[prefix] = make(map[string]int)
+			}
+			mc.Chain[prefix][suffix]++
+		}
+	}
+}
+
+// Распределение следующего токена с откатом к самому длинному известному контексту
+func (mc *MarkovChain) backoffNextTokens(prefix []string) map[string]float64 {
+	context := prefix
+	if len(context) > mc.Order-1 {
+		context = context[len(context)-mc.Order+1:]
+	}
+
+	for len(context) > 0 && mc.Chain[joinTokens(context)] == nil {
+		context = context[1:]
+	}
+	if mc.Chain[joinTokens(context)] == nil {
+		return nil
+	}
+
+	switch mc.Backoff {
+	case BackoffKatz:
+		return mc.backedOffNextTokens(context, mc.katzProbability)
+	case BackoffARPA:
+		return mc.backedOffNextTokens(context, mc.arpaProbability)
+	default:
+		return mc.mleNextTokens(context)
+	}
+}
+
+// Оценка максимального правдоподобия для известного контекста
+func (mc *MarkovChain) mleNextTokens(context []string) map[string]float64 {
+	prefixKey := joinTokens(context)
+	total := float64(mc.Sums[prefixKey])
+
+	probabilities := make(map[string]float64)
+	for suffix, count := range mc.Chain[prefixKey] {
+		probabilities[suffix] = float64(count) / total
+	}
+	return probabilities
+}
+
+// Распределение модели с откатом (Katz или ARPA): продолжения контекста и
+// продолжения более коротких непустых контекстов. Униграммы в кандидаты
+// не входят, поэтому сумма вероятностей может быть меньше 1
+func (mc *MarkovChain) backedOffNextTokens(context []string, probability func([]string, string) float64) map[string]float64 {
+	probabilities := make(map[string]float64)
+	for suffix := range mc.Chain[joinTokens(context)] {
+		probabilities[suffix] = probability(context, suffix)
+	}
+	if len(context) == 0 {
+		return probabilities
+	}
+
+	for lower := context[1:]; len(lower) > 0; lower = lower[1:] {
+		for suffix := range mc.Chain[joinTokens(lower)] {
+			if _, seen := probabilities[suffix]; !seen {
+				probabilities[suffix] = probability(context, suffix)
+			}
+		}
+	}
+	return probabilities
+}
+
+// Вероятность токена после контекста по Katz
+func (mc *MarkovChain) katzProbability(context []string, token string) float64 {
+	prefixKey := joinTokens(context)
+	total := mc.Sums[prefixKey]
+
+	if len(context) == 0 {
+		if total == 0 {
+			return 0
+		}
+		return float64(mc.Chain[prefixKey][token]) / float64(total)
+	}
+	if total == 0 {
+		return mc.katzProbability(context[1:], token)
+	}
+
+	if count := mc.Chain[prefixKey][token]; count > 0 {
+		return mc.katzContextDiscount(context, count, mc.katzSaturated(context)) * float64(count) / float64(total)
+	}
+
+	weight, uniform := mc.katzBackoff(context)
+	if uniform {
+		return weight
+	}
+	return weight * mc.katzProbability(context[1:], token)
+}
+
+// Продолжения контекста в порядке токенов, чтобы суммы масс не зависели
+// от обхода словаря
+func (mc *MarkovChain) sortedSuffixes(prefixKey string) []string {
+	suffixes := make([]string, 0, len(mc.Chain[prefixKey]))
+	for suffix := range mc.Chain[prefixKey] {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	return suffixes
+}
+
+// Не оставляют ли дисконты Гуда-Тьюринга массы для невиденных
+// продолжений контекста (все счетчики больше katzMaxCount)
+func (mc *MarkovChain) katzSaturated(context []string) bool {
+	prefixKey := joinTokens(context)
+	total := float64(mc.Sums[prefixKey])
+
+	seenMass := 0.0
+	for _, suffix := range mc.sortedSuffixes(prefixKey) {
+		count := mc.Chain[prefixKey][suffix]
+		seenMass += mc.katzDiscount(len(context)+1, count) * float64(count) / total
+	}
+	return seenMass >= 1-katzEpsilon
+}
+
+// Дисконт счетчика в контексте; в насыщенном контексте используется
+// абсолютный дисконт 0.5, чтобы вероятности оставались положительными
+func (mc *MarkovChain) katzContextDiscount(context []string, count int, saturated bool) float64 {
+	if saturated {
+		return (float64(count) - 0.5) / float64(count)
+	}
+	return mc.katzDiscount(len(context)+1, count)
+}
+
+// Вес отката: оставшаяся масса контекста, нормированная на массу
+// более короткого контекста, не занятую уже виденными продолжениями.
+// Если более короткий контекст отдает всю массу виденным продолжениям,
+// оставшаяся масса делится поровну между невиденными, и uniform = true:
+// тогда weight — уже вероятность невиденного токена
+func (mc *MarkovChain) katzBackoff(context []string) (weight float64, uniform bool) {
+	prefixKey := joinTokens(context)
+	total := float64(mc.Sums[prefixKey])
+	suffixes := mc.sortedSuffixes(prefixKey)
+	saturated := mc.katzSaturated(context)
+
+	seenMass := 0.0
+	lowerMass := 0.0
+	for _, suffix := range suffixes {
+		count := mc.Chain[prefixKey][suffix]
+		seenMass += mc.katzContextDiscount(context, count, saturated) * float64(count) / total
+		lowerMass += mc.katzProbability(context[1:], suffix)
+	}
+
+	if lowerMass >= 1-katzEpsilon {
+		unseen := mc.vocabularySize() - len(suffixes)
+		if unseen <= 0 {
+			return 0, true
+		}
+		return (1 - seenMass) / float64(unseen), true
+	}
+	return (1 - seenMass) / (1 - lowerMass), false
+}
+
+// Коэффициент дисконтирования для N-граммы порядка n с данным счетчиком
+func (mc *MarkovChain) katzDiscount(n, count int) float64 {
+	if count > katzMaxCount {
+		return 1
+	}
+	discounts, exists := mc.katzDiscounts[n]
+	if !exists {
+		return 1
+	}
+	return discounts[count]
+}
+
+// Оценка дисконтов Гуда-Тьюринга по числу N-грамм с каждым счетчиком
+func (mc *MarkovChain) estimateKatzDiscounts() {
+	mc.katzDiscounts = nil
+	if mc.Backoff != BackoffKatz {
+		return
+	}
+
+	countOfCounts := make(map[int][]int)
+	for prefix, suffixes := range mc.Chain {
+		n := prefixLength(prefix) + 1
+		if countOfCounts[n] == nil {
+			countOfCounts[n] = make([]int, katzMaxCount+2)
+		}
+		for _, count := range suffixes {
+			if count <= katzMaxCount+1 {
+				countOfCounts[n][count]++
+			}
+		}
+	}
+
+	mc.katzDiscounts = make(map[int][]float64)
+	for n, nr := range countOfCounts {
+		discounts := make([]float64, katzMaxCount+1)
+		k := katzMaxCount
+		for r := 1; r <= k; r++ {
+			discounts[r] = goodTuringDiscount(nr, r, k)
+		}
+		mc.katzDiscounts[n] = discounts
+	}
+}
+
+// Дисконт Гуда-Тьюринга для счетчика r; при недостатке статистики
+// используется абсолютный дисконт 0.5
+func goodTuringDiscount(nr []int, r, k int) float64 {
+	fallback := (float64(r) - 0.5) / float64(r)
+	if nr[1] == 0 || nr[r] == 0 || nr[r+1] == 0 {
+		return fallback
+	}
+
+	common := float64(k+1) * float64(nr[k+1]) / float64(nr[1])
+	adjusted := float64(r+1) * float64(nr[r+1]) / float64(nr[r])
+	discount := (adjusted/float64(r) - common) / (1 - common)
+
+	if discount <= 0 || discount >= 1 {
+		return fallback
+	}
+	return discount
+}
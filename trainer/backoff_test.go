@@ -0,0 +1,24 @@
+package trainer
+
+import (
+	"strings"
+	"testing"
+)
+
+// Сообщение о неизвестном откате перечисляет все допустимые значения
+func TestValidBackoffListsAcceptedValues(t *testing.T) {
+	for _, backoff := range []string{BackoffNone, BackoffStupid, BackoffKatz, BackoffARPA} {
+		if err := validBackoff(backoff); err != nil {
+			t.Fatalf("backoff %q was rejected: %v", backoff, err)
+		}
+	}
+	err := validBackoff("kats")
+	if err == nil {
+		t.Fatalf("unknown backoff was accepted")
+	}
+	for _, backoff := range []string{BackoffStupid, BackoffKatz, BackoffARPA} {
+		if !strings.Contains(err.Error(), backoff) {
+			t.Fatalf("error %q does not mention accepted backoff %q", err, backoff)
+		}
+	}
+}
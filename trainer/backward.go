@@ -0,0 +1,98 @@
+package trainer
+
+import (
+	"fmt"
+)
+
+// Обратная цепь в файле модели. Порядок, откат, словарь и индекс общие
+// с прямой цепью, поэтому хранятся только счетчики и параметры сглаживания
+type backwardPayload struct {
+	Smoothing *Smoothing                `json:"smoothing,omitempty"`
+	Chain     map[string]map[string]int `json:"chain"`
+	Sums      map[string]int            `json:"sums"`
+}
+
+// Обратное предложение: токены справа налево, <start> и <end> меняются
+// местами, поэтому обратная цепь обучается и используется как обычная,
+// а <end> в ней означает начало исходного предложения
+func ReverseSentence(sentence []string) []string {
+	reversed := make([]string, len(sentence))
+	for i, token := range sentence {
+		switch token {
+		case "<start>":
+			token = "<end>"
+		case "<end>":
+			token = "<start>"
+		}
+		reversed[len(sentence)-1-i] = token
+	}
+	return reversed
+}
+
+// Пустая обратная цепь с настройками прямой
+func (mc *MarkovChain) newBackwardChain() *MarkovChain {
+	backward := &MarkovChain{
+		Order:   mc.Order,
+		Backoff: mc.Backoff,
+		Meta:    mc.Meta,
+		config:  mc.config,
+	}
+	if mc.Smoothing != nil {
+		backward.Smoothing = &Smoothing{Method: mc.Smoothing.Method, K: mc.Smoothing.K}
+	}
+	backward.ensureTables()
+	return backward
+}
+
+// Обучение обратной цепи на тех же предложениях
+func (mc *MarkovChain) trainBackward(sentences [][]string) {
+	if mc.Backward == nil {
+		mc.Backward = mc.newBackwardChain()
+	}
+	mc.Backward.config = mc.config
+
+	reversed := make([][]string, len(sentences))
+	for i, sentence := range sentences {
+		reversed[i] = ReverseSentence(sentence)
+	}
+	mc.Backward.countSentences(reversed)
+	mc.Backward.calculateSums()
+
+	fmt.Printf("Backward chain size: %d prefixes\n", len(mc.Backward.Chain))
+}
+
+// Обратная цепь для сохранения
+func (mc *MarkovChain) backwardPayload() *backwardPayload {
+	if mc.Backward == nil {
+		return nil
+	}
+	return &backwardPayload{
+		Smoothing: mc.Backward.Smoothing,
+		Chain:     mc.Backward.Chain,
+		Sums:      mc.Backward.Sums,
+	}
+}
+
+// Восстановление обратной цепи из файла; словарь копируется из прямой цепи
+func (mc *MarkovChain) loadBackward(payload *backwardPayload) {
+	if payload == nil {
+		return
+	}
+
+	vocab := make(map[string]int, len(mc.Vocab))
+	for token, count := range mc.Vocab {
+		vocab[token] = count
+	}
+	mc.Backward = &MarkovChain{
+		Order:     mc.Order,
+		Backoff:   mc.Backoff,
+		Smoothing: payload.Smoothing,
+		Chain:     payload.Chain,
+		Sums:      payload.Sums,
+		Vocab:     vocab,
+		Meta:      mc.Meta,
+	}
+	mc.Backward.ensureTables()
+	mc.Backward.estimateKatzDiscounts()
+	mc.Backward.prepareSmoothing()
+}
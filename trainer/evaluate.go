@@ -0,0 +1,95 @@
+package trainer
+
+import (
+	"math"
+	"time"
+)
+
+// Результаты оценки модели на отложенном корпусе
+type EvalReport struct {
+	Model        string          `json:"model,omitempty"`   // Путь к модели
+	Corpus       string          `json:"corpus,omitempty"`  // Путь к отложенному корпусу
+	EvaluatedAt  time.Time       `json:"evaluated_at"`      // Время оценки
+	Order        int             `json:"order"`             // Порядок модели
+	Smoothing    string          `json:"smoothing"`         // Метод сглаживания, по которому считались вероятности
+	Backoff      string          `json:"backoff,omitempty"` // Режим отката модели
+	Sentences    int             `json:"sentences"`         // Число предложений
+	Tokens       int             `json:"tokens"`            // Число предсказанных токенов, включая <end>
+	OOVTokens    int             `json:"oov_tokens"`        // Токены вне словаря модели
+	OOVRate      float64         `json:"oov_rate"`          // Доля токенов вне словаря
+	CrossEntropy float64         `json:"cross_entropy"`     // Кросс-энтропия, бит на токен
+	Perplexity   float64         `json:"perplexity"`        // Перплексия
+	Hits         map[int]int     `json:"ngram_hits"`        // Порядок -> число токенов, чья N-грамма есть в цепи
+	Coverage     map[int]float64 `json:"coverage"`          // Порядок -> доля таких токенов среди известных
+}
+
+// Оценка модели: перплексия, кросс-энтропия, доля неизвестных токенов
+// и покрытие N-грамм по порядкам. Неизвестные токены в энтропию не входят.
+// Модели без сглаживания и с stupid backoff нормированных вероятностей не
+// имеют, для них оценка идет по add-one, которого нет при генерации
+func (mc *MarkovChain) Evaluate(sentences [][]string) EvalReport {
+	report := EvalReport{
+		EvaluatedAt: time.Now().UTC(),
+		Order:       mc.Order,
+		Smoothing:   "add-one (eval only)",
+		Backoff:     mc.Backoff,
+		Sentences:   len(sentences),
+		Hits:        make(map[int]int),
+		Coverage:    make(map[int]float64),
+	}
+	if mc.Smoothing != nil {
+		report.Smoothing = mc.Smoothing.Method
+	} else if mc.Backoff == BackoffKatz || mc.Backoff == BackoffARPA {
+		report.Smoothing = mc.Backoff
+	}
+
+	lowest := mc.Order
+	if mc.IsVariableOrder() {
+		lowest = 1
+	}
+
+	logSum := 0.0
+	known := 0
+	for _, sentence := range sentences {
+		for i := 1; i < len(sentence); i++ {
+			token := sentence[i]
+			context := sentence[max(0, i-mc.Order+1):i]
+			report.Tokens++
+
+			if !mc.inVocabulary(token) {
+				report.OOVTokens++
+				continue
+			}
+			logSum += math.Log2(mc.Probability(context, token))
+			known++
+
+			for n := lowest; n <= mc.Order && n <= len(context)+1; n++ {
+				if mc.Chain[joinTokens(context[len(context)-n+1:])][token] > 0 {
+					report.Hits[n]++
+				}
+			}
+		}
+	}
+
+	if report.Tokens > 0 {
+		report.OOVRate = float64(report.OOVTokens) / float64(report.Tokens)
+	}
+	if known == 0 {
+		report.CrossEntropy = math.Inf(1)
+		report.Perplexity = math.Inf(1)
+		return report
+	}
+
+	report.CrossEntropy = -logSum / float64(known)
+	report.Perplexity = math.Pow(2, report.CrossEntropy)
+	for n := lowest; n <= mc.Order; n++ {
+		report.Coverage[n] = float64(report.Hits[n]) / float64(known)
+	}
+
+	return report
+}
+
+// Перплексия модели на отложенных предложениях
+func (mc *MarkovChain) Perplexity(sentences [][]string) float64 {
+	return mc.Evaluate(sentences).Perplexity
+}
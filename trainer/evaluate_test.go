@@ -0,0 +1,29 @@
+package trainer
+
+import "testing"
+
+// Неизвестным считается только токен вне словаря: «описывает» после
+// начала «модель» в корпусе не встречалось, но слово известно и входит
+// в энтропию, а «квазары» в словаре нет
+func TestEvaluateCountsOOVByVocabulary(t *testing.T) {
+	mc := trainTestModel(t, TrainConfig{Order: 3, Backoff: BackoffKatz})
+	report := mc.Evaluate([][]string{{"<start>", "модель", "описывает", "квазары", "<end>"}})
+	if report.Tokens != 4 || report.OOVTokens != 1 {
+		t.Fatalf("got %d tokens and %d OOV, expected 4 and 1", report.Tokens, report.OOVTokens)
+	}
+}
+
+// Метка сглаживания соответствует вероятностям, по которым шла оценка:
+// модели без сглаживания и со stupid backoff оцениваются по add-one
+func TestEvaluateSmoothingLabel(t *testing.T) {
+	heldOut := testSentences(t)[:1]
+	for _, backoff := range []string{BackoffNone, BackoffStupid} {
+		report := trainTestModel(t, TrainConfig{Order: 2, Backoff: backoff}).Evaluate(heldOut)
+		if report.Smoothing != "add-one (eval only)" || report.Backoff != backoff {
+			t.Fatalf("backoff %q: labelled %q with backoff %q", backoff, report.Smoothing, report.Backoff)
+		}
+	}
+	if report := trainTestModel(t, TrainConfig{Order: 2, Backoff: BackoffKatz}).Evaluate(heldOut); report.Smoothing != BackoffKatz {
+		t.Fatalf("katz model labelled %q", report.Smoothing)
+	}
+}
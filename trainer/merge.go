@@ -0,0 +1,214 @@
+package trainer
+
+import (
+	"fmt"
+	"math"
+)
+
+// Загрузка модели для дообучения на новых данных
+func ContinueTraining(path string, config TrainConfig) (*MarkovChain, error) {
+	mc, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mc.Backoff == BackoffARPA {
+		return nil, fmt.Errorf("cannot continue training: model was imported from ARPA and has no counts")
+	}
+	if config.Backward && mc.Backward == nil {
+		return nil, fmt.Errorf("cannot continue training: model has no backward chain, retrain it from scratch")
+	}
+	if config.Topics > 0 && mc.TopicModel == nil {
+		return nil, fmt.Errorf("cannot continue training: model has no topic model, retrain it from scratch")
+	}
+	if config.Topics > 0 && config.Topics != mc.TopicModel.Count() {
+		return nil, fmt.Errorf("cannot continue training: model has %d topics, requested %d", mc.TopicModel.Count(), config.Topics)
+	}
+	if config.NoveltyNGram > 0 && mc.Ngrams == nil {
+		return nil, fmt.Errorf("cannot continue training: model has no novelty n-gram set, retrain it from scratch")
+	}
+	if config.NoveltyNGram > 0 && config.NoveltyNGram != mc.Ngrams.N {
+		return nil, fmt.Errorf("cannot continue training: model novelty n-grams have size %d, requested %d", mc.Ngrams.N, config.NoveltyNGram)
+	}
+	if config.Order != 0 && config.Order != mc.Order {
+		return nil, fmt.Errorf("cannot continue training: model order is %d, requested %d", mc.Order, config.Order)
+	}
+	if mc.Meta.Tokenizer != config.Tokenizer {
+		return nil, fmt.Errorf("cannot continue training: model tokenizer settings %+v differ from %+v", mc.Meta.Tokenizer, config.Tokenizer)
+	}
+	if config.Backoff != BackoffNone && config.Backoff != mc.Backoff {
+		return nil, fmt.Errorf("cannot continue training: model backoff is %q, requested %q", mc.Backoff, config.Backoff)
+	}
+	if config.Smoothing != "" && (mc.Smoothing == nil || config.Smoothing != mc.Smoothing.Method) {
+		return nil, fmt.Errorf("cannot continue training: model smoothing differs from requested %q", config.Smoothing)
+	}
+	if unit := mc.Meta.Training.Unit; unit != "unknown" && unit != config.Unit {
+		return nil, fmt.Errorf("cannot continue training: model was trained on %s, not %s", unit, config.Unit)
+	}
+
+	mc.Meta.Training.Unit = config.Unit
+	mc.config = config
+	return mc, nil
+}
+
+// Объединение моделей одного порядка суммированием счетчиков с весами
+func Merge(models []*MarkovChain, weights []float64) (*MarkovChain, error) {
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no models to merge")
+	}
+	if weights == nil {
+		weights = make([]float64, len(models))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(models) {
+		return nil, fmt.Errorf("got %d weights for %d models", len(weights), len(models))
+	}
+
+	first := models[0]
+	for i, model := range models {
+		if model.Order != first.Order {
+			return nil, fmt.Errorf("model %d has order %d, expected %d", i+1, model.Order, first.Order)
+		}
+		if model.Meta.Tokenizer != first.Meta.Tokenizer {
+			return nil, fmt.Errorf("model %d has tokenizer settings %+v, expected %+v", i+1, model.Meta.Tokenizer, first.Meta.Tokenizer)
+		}
+		if model.Backoff == BackoffARPA {
+			return nil, fmt.Errorf("model %d was imported from ARPA and has no counts to merge", i+1)
+		}
+		if model.Backoff != first.Backoff {
+			return nil, fmt.Errorf("model %d has backoff %q, expected %q", i+1, model.Backoff, first.Backoff)
+		}
+		if !sameSmoothing(model.Smoothing, first.Smoothing) {
+			return nil, fmt.Errorf("model %d has smoothing %s, expected %s", i+1, describeSmoothing(model.Smoothing), describeSmoothing(first.Smoothing))
+		}
+		if (model.Backward != nil) != (first.Backward != nil) {
+			return nil, fmt.Errorf("model %d backward chain presence differs from model 1", i+1)
+		}
+		if weights[i] <= 0 {
+			return nil, fmt.Errorf("weight of model %d must be positive, got %g", i+1, weights[i])
+		}
+	}
+	weights = relativeWeights(weights)
+
+	merged := NewMarkovTrainer(TrainConfig{
+		Order:        first.Order,
+		MinFrequency: first.Meta.Training.MinFrequency,
+		Tokenizer:    first.Meta.Tokenizer,
+		Unit:         first.Meta.Training.Unit,
+		Backoff:      first.Backoff,
+	})
+	if first.Smoothing != nil {
+		merged.Smoothing = &Smoothing{Method: first.Smoothing.Method, K: first.Smoothing.K}
+	}
+
+	if first.Backward != nil {
+		merged.Backward = merged.newBackwardChain()
+		merged.Meta.Training.Backward = true
+	}
+	if mergeableNgrams(models) {
+		merged.Ngrams = NewNgramSet(first.Ngrams.N)
+		merged.Meta.Training.NoveltyNGram = first.Ngrams.N
+	}
+
+	for i, model := range models {
+		if model.TopicModel != nil {
+			fmt.Printf("Topic model of model %d is dropped: topics of different models cannot be merged, retrain with --topics\n", i+1)
+		}
+		if merged.Ngrams != nil {
+			merged.Ngrams.Merge(model.Ngrams)
+		} else if model.Ngrams != nil {
+			fmt.Printf("Novelty n-gram set of model %d is dropped: all models need sets of the same size\n", i+1)
+		}
+		merged.addCounts(model, weights[i])
+		if merged.Backward != nil {
+			merged.Backward.addCounts(model.Backward, weights[i])
+		}
+
+		if model.Meta.Training.Unit != merged.Meta.Training.Unit {
+			merged.Meta.Training.Unit = "mixed"
+		}
+		merged.Meta.Corpus = append(merged.Meta.Corpus, model.Meta.Corpus...)
+	}
+
+	merged.calculateSums()
+	if merged.Backward != nil {
+		merged.Backward.calculateSums()
+	}
+	merged.RecomputeStats()
+	merged.Meta.TrainedAt = trainingTime()
+
+	return merged, nil
+}
+
+// Совпадают ли метод сглаживания и его параметр k
+func sameSmoothing(a, b *Smoothing) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Method == b.Method && a.K == b.K
+}
+
+// Описание сглаживания для сообщений об ошибках
+func describeSmoothing(s *Smoothing) string {
+	switch {
+	case s == nil:
+		return "none"
+	case s.Method == SmoothingAddK:
+		return fmt.Sprintf("%q with k=%g", s.Method, s.K)
+	default:
+		return fmt.Sprintf("%q", s.Method)
+	}
+}
+
+// Веса относительно наибольшего: счетчики только уменьшаются, и модель
+// с наибольшим весом входит в объединение как есть
+func relativeWeights(weights []float64) []float64 {
+	largest := 0.0
+	for _, weight := range weights {
+		largest = max(largest, weight)
+	}
+	relative := make([]float64, len(weights))
+	for i, weight := range weights {
+		relative[i] = weight / largest
+	}
+	return relative
+}
+
+// Есть ли у всех моделей наборы N-грамм одного размера
+func mergeableNgrams(models []*MarkovChain) bool {
+	for _, model := range models {
+		if model.Ngrams == nil || model.Ngrams.N != models[0].Ngrams.N {
+			return false
+		}
+	}
+	return true
+}
+
+// Добавляем счетчики другой модели с весом; индекс дополняется в порядке вызовов
+func (mc *MarkovChain) addCounts(other *MarkovChain, weight float64) {
+	for prefix, suffixes := range other.Chain {
+		for suffix, count := range suffixes {
+			if mc.Chain[prefix] == nil {
+				mc.Chain[prefix] = make(map[string]int)
+			}
+			mc.Chain[prefix][suffix] += scaleCount(count, weight)
+		}
+	}
+
+	for token, count := range other.Vocab {
+		mc.Vocab[token] += scaleCount(count, weight)
+	}
+
+	mc.Index.Merge(other.Index)
+}
+
+// Умножение счетчика на вес с округлением. Встреченный переход не должен
+// пропасть из модели, поэтому положительный счетчик остается не меньше 1
+func scaleCount(count int, weight float64) int {
+	if count <= 0 {
+		return 0
+	}
+	return max(1, int(math.Round(float64(count)*weight)))
+}
@@ -0,0 +1,50 @@
+package trainer
+
+import (
+	"strings"
+	"testing"
+)
+
+// Переходы модели с малым весом не пропадают из объединения
+func TestMergeKeepsRareTransitions(t *testing.T) {
+	a := trainTestModel(t, TrainConfig{Order: 2})
+	b := NewMarkovTrainer(TrainConfig{Order: 2, Tokenizer: a.Meta.Tokenizer})
+	if err := b.Train([][]string{{"<start>", "редкое", "слово", "<end>"}}); err != nil {
+		t.Fatalf("training failed: %v", err)
+	}
+
+	merged, err := Merge([]*MarkovChain{a, b}, []float64{1, 0.1})
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	for _, model := range []*MarkovChain{a, b} {
+		for prefix, suffixes := range model.Chain {
+			for suffix := range suffixes {
+				if merged.Chain[prefix][suffix] == 0 {
+					t.Fatalf("transition %s -> %s was lost in the merge", prefix, suffix)
+				}
+			}
+		}
+	}
+	if merged.Vocab["редкое"] == 0 {
+		t.Fatalf("token of the low-weight model was lost in the merge")
+	}
+}
+
+// Модели с разным сглаживанием не объединяются
+func TestMergeRejectsDifferentSmoothing(t *testing.T) {
+	cases := map[string][2]TrainConfig{
+		"method": {{Order: 2, Smoothing: SmoothingAddK, SmoothingK: 0.5}, {Order: 2, Smoothing: SmoothingWittenBell}},
+		"k":      {{Order: 2, Smoothing: SmoothingAddK, SmoothingK: 0.5}, {Order: 2, Smoothing: SmoothingAddK, SmoothingK: 0.1}},
+		"none":   {{Order: 2}, {Order: 2, Smoothing: SmoothingAddK, SmoothingK: 1}},
+	}
+	for name, configs := range cases {
+		t.Run(name, func(t *testing.T) {
+			models := []*MarkovChain{trainTestModel(t, configs[0]), trainTestModel(t, configs[1])}
+			_, err := Merge(models, nil)
+			if err == nil || !strings.Contains(err.Error(), "smoothing") {
+				t.Fatalf("expected a smoothing mismatch error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package trainer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"markmach/retrieval"
+	"markmach/tokenizer"
+)
+
+// Текущая версия формата файла модели. Повышается при каждом изменении
+// содержимого, которое меняет смысл модели, чтобы старые версии программы
+// отказывались читать файл, а не молча игнорировали незнакомые поля.
+// Каждое повышение добавляет шаг в migrations
+const FormatVersion = 9
+
+// Семантика порядка: Order = N означает N-граммы с префиксом из N-1 токенов
+const OrderSemanticsNGram = "ngram"
+
+// Метаданные модели, сохраняемые в заголовке файла
+type Metadata struct {
+	FormatVersion int              `json:"format_version"` // Версия формата файла
+	Tokenizer     tokenizer.Config `json:"tokenizer"`      // Настройки токенизатора при обучении
+	Corpus        []CorpusFile     `json:"corpus"`         // Файлы корпуса с хешами
+	TrainedAt     time.Time        `json:"trained_at"`     // Дата обучения
+	Training      TrainingFlags    `json:"training"`       // Параметры обучения
+	Checksum      string           `json:"checksum"`       // SHA-256 содержимого модели
+}
+
+// Файл корпуса, на котором обучалась модель
+type CorpusFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Параметры, с которыми запускалось обучение
+type TrainingFlags struct {
+	Order          int          `json:"order"`                   // Порядок цепи
+	OrderSemantics string       `json:"order_semantics"`         // Смысл порядка цепи
+	Unit           string       `json:"unit"`                    // Единица обучения: sentences, paragraphs или text
+	MinFrequency   int          `json:"min_frequency"`           // Минимальная частота перехода
+	MinPrefixCount int          `json:"min_prefix_count"`        // Минимальное число переходов из префикса
+	TopK           int          `json:"top_k"`                   // Ограничение числа продолжений у префикса
+	Backoff        string       `json:"backoff,omitempty"`       // Стратегия отката к коротким контекстам
+	Smoothing      string       `json:"smoothing,omitempty"`     // Метод сглаживания вероятностей
+	Split          *SplitConfig `json:"split,omitempty"`         // Разбиение корпуса, если обучение шло на его части
+	Backward       bool         `json:"backward,omitempty"`      // Есть ли обратная цепь
+	Topics         int          `json:"topics,omitempty"`        // Число тем тематической модели
+	NoveltyNGram   int          `json:"novelty_ngram,omitempty"` // Длина N-грамм набора для проверки копирования
+}
+
+// Создание метаданных для новой модели
+func newMetadata(config TrainConfig) *Metadata {
+	semantics := OrderSemanticsNGram
+	if config.Backoff != BackoffNone || config.smoothing().needsLowerOrders() {
+		semantics = OrderSemanticsVariable
+	}
+
+	return &Metadata{
+		FormatVersion: FormatVersion,
+		Tokenizer:     config.Tokenizer,
+		Training: TrainingFlags{
+			Order:          config.Order,
+			OrderSemantics: semantics,
+			Unit:           config.Unit,
+			MinFrequency:   config.MinFrequency,
+			MinPrefixCount: config.MinPrefix,
+			TopK:           config.TopK,
+			Backoff:        config.Backoff,
+			Smoothing:      config.Smoothing,
+			Backward:       config.Backward,
+		},
+	}
+}
+
+// Время обучения; SOURCE_DATE_EPOCH позволяет получать побайтно воспроизводимые модели
+func trainingTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if seconds, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(seconds, 0).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
+// Запоминаем файлы корпуса и их хеши
+func (mc *MarkovChain) RecordCorpus(paths []string) error {
+	for _, path := range paths {
+		file, err := hashCorpusFile(path)
+		if err != nil {
+			return err
+		}
+		mc.Meta.Corpus = append(mc.Meta.Corpus, file)
+	}
+	return nil
+}
+
+// Вычисляем хеш файла корпуса
+func hashCorpusFile(path string) (CorpusFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return CorpusFile{}, fmt.Errorf("failed to open corpus file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return CorpusFile{}, fmt.Errorf("failed to hash corpus file: %w", err)
+	}
+
+	return CorpusFile{
+		Path:   path,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Контрольная сумма содержимого модели
+func checksum(payload modelPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal model payload: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Миграции формата: версия -> функция перевода на следующую версию.
+// nil — содержимое переводить не нужно: новое поле необязательно, и без
+// него модель читается так же, как читалась предыдущей версией программы
+var migrations = map[int]func(*modelFile) error{
+	0: migrateLegacy,
+	1: migrateSentenceIndex,
+	2: migrateStats,
+	3: nil, // Версия 4: откат к коротким контекстам (backoff); без поля — только префиксы длины Order-1
+	4: nil, // Версия 5: сглаживание (smoothing); без поля — add-one при оценке
+	5: nil, // Версия 6: таблицы ARPA (arpa); есть только у импортированных моделей
+	6: nil, // Версия 7: обратная цепь (backward); без нее ответ растет только вперед
+	7: nil, // Версия 8: темы LDA (topics, topic_model); без них ответы не учитывают тему
+	8: nil, // Версия 9: набор N-грамм корпуса (ngrams); без него защита от копирования недоступна
+}
+
+// Приводим файл модели к текущей версии формата
+func migrate(file *modelFile) error {
+	if file.Metadata == nil {
+		file.Metadata = &Metadata{}
+	}
+
+	version := file.Metadata.FormatVersion
+	if version > FormatVersion {
+		return fmt.Errorf("model format version %d is newer than supported version %d", version, FormatVersion)
+	}
+
+	for version < FormatVersion {
+		step, exists := migrations[version]
+		if !exists {
+			return fmt.Errorf("no migration from model format version %d", version)
+		}
+		if step != nil {
+			if err := step(file); err != nil {
+				return fmt.Errorf("failed to migrate model from format version %d: %w", version, err)
+			}
+		}
+		version++
+		file.Metadata.FormatVersion = version
+		fmt.Printf("Model migrated from format version %d to %d\n", version-1, version)
+	}
+
+	return nil
+}
+
+// Модели без метаданных обучались командой train с настройками по умолчанию
+func migrateLegacy(file *modelFile) error {
+	file.Metadata.Tokenizer = tokenizer.Config{
+		KeepPunctuation: true,
+		ToLowerCase:     true,
+	}
+	file.Metadata.Training = TrainingFlags{
+		Order:          file.Order,
+		OrderSemantics: OrderSemanticsNGram,
+		Unit:           "unknown",
+	}
+
+	sum, err := checksum(file.modelPayload)
+	if err != nil {
+		return err
+	}
+	file.Metadata.Checksum = sum
+	return nil
+}
+
+// Версия 1 хранила в индексе полные предложения под каждым словом;
+// уникальные предложения переносятся в хранилище документов поискового индекса
+func migrateSentenceIndex(file *modelFile) error {
+	sum, err := checksum(file.modelPayload)
+	if err != nil {
+		return err
+	}
+	if sum != file.Metadata.Checksum {
+		return fmt.Errorf("model checksum mismatch: expected %s, got %s (file is corrupted or was edited)", file.Metadata.Checksum, sum)
+	}
+
+	var legacy map[string][]string
+	if len(file.Index) > 0 {
+		if err := json.Unmarshal(file.Index, &legacy); err != nil {
+			return fmt.Errorf("failed to read legacy index: %w", err)
+		}
+	}
+
+	unique := make(map[string]bool)
+	var sentences []string
+	for _, indexed := range legacy {
+		for _, sentence := range indexed {
+			sentence = strings.TrimSpace(strings.NewReplacer("<start>", "", "<end>", "").Replace(sentence))
+			if sentence != "" && !unique[sentence] {
+				unique[sentence] = true
+				sentences = append(sentences, sentence)
+			}
+		}
+	}
+	sort.Strings(sentences)
+
+	tkz := tokenizer.NewTokenizer(file.Metadata.Tokenizer)
+	index := retrieval.New()
+	for _, sentence := range sentences {
+		index.Add(sentence, "", tkz.Tokenize(sentence))
+	}
+
+	file.Index, err = json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	file.Metadata.Checksum, err = checksum(file.modelPayload)
+	return err
+}
+
+// Версия 3 добавила статистику токенов; для старых моделей она вычисляется
+// по цепи, словарю и индексу
+func migrateStats(file *modelFile) error {
+	sum, err := checksum(file.modelPayload)
+	if err != nil {
+		return err
+	}
+	if sum != file.Metadata.Checksum {
+		return fmt.Errorf("model checksum mismatch: expected %s, got %s (file is corrupted or was edited)", file.Metadata.Checksum, sum)
+	}
+
+	mc := &MarkovChain{Order: file.Order, Chain: file.Chain, Vocab: file.Vocab}
+	if len(file.Index) > 0 {
+		if err := json.Unmarshal(file.Index, &mc.Index); err != nil {
+			return fmt.Errorf("failed to unmarshal index: %w", err)
+		}
+	}
+	file.Stats = mc.ComputeStats()
+
+	file.Metadata.Checksum, err = checksum(file.modelPayload)
+	return err
+}
+
+// Проверка целостности и совместимости модели
+func validate(file *modelFile) error {
+	meta := file.Metadata
+
+	sum, err := checksum(file.modelPayload)
+	if err != nil {
+		return err
+	}
+	if sum != meta.Checksum {
+		return fmt.Errorf("model checksum mismatch: expected %s, got %s (file is corrupted or was edited)", meta.Checksum, sum)
+	}
+
+	if err := validBackoff(file.Backoff); err != nil {
+		return err
+	}
+	if err := file.Smoothing.validate(); err != nil {
+		return err
+	}
+	if (file.Backoff == BackoffARPA) != (file.ARPA != nil) {
+		return fmt.Errorf("ARPA tables must be present exactly when backoff is %q", BackoffARPA)
+	}
+
+	variable := file.Backoff != BackoffNone || file.Smoothing.needsLowerOrders()
+	switch meta.Training.OrderSemantics {
+	case OrderSemanticsNGram:
+		if variable {
+			return fmt.Errorf("backoff and interpolated smoothing require %q order semantics", OrderSemanticsVariable)
+		}
+	case OrderSemanticsVariable:
+		if !variable {
+			return fmt.Errorf("%q order semantics requires a backoff strategy or interpolated smoothing", OrderSemanticsVariable)
+		}
+	default:
+		return fmt.Errorf("unsupported order semantics %q", meta.Training.OrderSemantics)
+	}
+	if file.Order < 1 {
+		return fmt.Errorf("invalid model order %d", file.Order)
+	}
+	if meta.Training.Order != file.Order {
+		return fmt.Errorf("model order %d does not match training order %d", file.Order, meta.Training.Order)
+	}
+
+	if err := validateChain(file.Chain, file.Sums, file.Order, variable); err != nil {
+		return err
+	}
+
+	if meta.Training.Backward != (file.Backward != nil) {
+		return fmt.Errorf("backward chain presence does not match training flags")
+	}
+	if file.Backward != nil {
+		if err := file.Backward.Smoothing.validate(); err != nil {
+			return fmt.Errorf("backward chain: %w", err)
+		}
+		if err := validateChain(file.Backward.Chain, file.Backward.Sums, file.Order, variable); err != nil {
+			return fmt.Errorf("backward chain: %w", err)
+		}
+	}
+
+	if err := validateTopics(file); err != nil {
+		return err
+	}
+	if file.Ngrams == nil && meta.Training.NoveltyNGram != 0 {
+		return fmt.Errorf("novelty n-gram size is listed but the n-gram set is missing")
+	}
+	if file.Ngrams != nil {
+		if file.Ngrams.N != meta.Training.NoveltyNGram {
+			return fmt.Errorf("novelty n-gram size %d does not match training flags %d", file.Ngrams.N, meta.Training.NoveltyNGram)
+		}
+		if err := file.Ngrams.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Проверка размеров таблиц тематической модели
+func validateTopics(file *modelFile) error {
+	model := file.TopicModel
+	if model == nil {
+		if file.Metadata.Training.Topics != 0 || len(file.Topics) != 0 {
+			return fmt.Errorf("topics are listed but the topic model is missing")
+		}
+		return nil
+	}
+
+	topics := model.Count()
+	if topics == 0 || topics != file.Metadata.Training.Topics || len(file.Topics) != topics {
+		return fmt.Errorf("topic model has %d topics, training flags list %d and topic table %d", topics, file.Metadata.Training.Topics, len(file.Topics))
+	}
+	for word, counts := range model.Words {
+		if len(counts) != topics {
+			return fmt.Errorf("topic counts of %q have %d entries, expected %d", word, len(counts), topics)
+		}
+	}
+	for i, mixture := range model.Mixtures {
+		if len(mixture) != topics {
+			return fmt.Errorf("topic mixture of sentence %d has %d entries, expected %d", i, len(mixture), topics)
+		}
+	}
+	return nil
+}
+
+// Проверка длин префиксов и сумм переходов цепи
+func validateChain(chain map[string]map[string]int, sums map[string]int, order int, variable bool) error {
+	for prefix, suffixes := range chain {
+		length := prefixLength(prefix)
+		if variable && length > order-1 {
+			return fmt.Errorf("prefix %s has %d tokens, expected at most %d", prefix, length, order-1)
+		}
+		if !variable && length != order-1 {
+			return fmt.Errorf("prefix %s has %d tokens, expected %d", prefix, length, order-1)
+		}
+
+		sum := 0
+		for _, count := range suffixes {
+			sum += count
+		}
+		if sums[prefix] != sum {
+			return fmt.Errorf("sum for prefix %s is %d, expected %d", prefix, sums[prefix], sum)
+		}
+	}
+	if len(sums) != len(chain) {
+		return fmt.Errorf("sums table has %d prefixes, chain has %d", len(sums), len(chain))
+	}
+
+	return nil
+}
+
+// Количество токенов в ключе префикса
+func prefixLength(prefix string) int {
+	return len(prefixTokens(prefix))
+}
@@ -0,0 +1,53 @@
+package trainer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Файл модели, сохраненный в текущем формате
+func savedModelFile(t *testing.T, mc *MarkovChain) modelFile {
+	t.Helper()
+	var file modelFile
+	if err := json.Unmarshal(savedBytes(t, mc, "model.json"), &file); err != nil {
+		t.Fatalf("failed to unmarshal model: %v", err)
+	}
+	return file
+}
+
+// Миграция со второй версии вычисляет статистику токенов
+func TestMigrateStatsComputesStats(t *testing.T) {
+	mc := trainTestModel(t, TrainConfig{Order: 3})
+	file := savedModelFile(t, mc)
+
+	file.Stats = nil
+	file.Metadata.FormatVersion = 2
+	sum, err := checksum(file.modelPayload)
+	if err != nil {
+		t.Fatalf("checksum failed: %v", err)
+	}
+	file.Metadata.Checksum = sum
+
+	if err := migrate(&file); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if file.Metadata.FormatVersion != FormatVersion {
+		t.Fatalf("migrated to version %d, expected %d", file.Metadata.FormatVersion, FormatVersion)
+	}
+	if err := validate(&file); err != nil {
+		t.Fatalf("migrated model is invalid: %v", err)
+	}
+	if !reflect.DeepEqual(file.Stats, mc.Stats) {
+		t.Fatalf("migrated statistics differ from the trained ones")
+	}
+}
+
+// Модели из более новой версии формата не читаются
+func TestMigrateRejectsNewerFormat(t *testing.T) {
+	file := savedModelFile(t, trainTestModel(t, TrainConfig{Order: 2}))
+	file.Metadata.FormatVersion = FormatVersion + 1
+	if err := migrate(&file); err == nil {
+		t.Fatalf("model of format version %d was accepted", file.Metadata.FormatVersion)
+	}
+}
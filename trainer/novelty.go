@@ -0,0 +1,131 @@
+package trainer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Хешированный набор N-грамм корпуса для проверки дословного копирования.
+// Служебные токены в N-граммы не входят
+type NgramSet struct {
+	N      int      `json:"n"`
+	Hashes []uint64 `json:"hashes"` // Хеши FNV-1a по возрастанию, без повторов
+}
+
+// Пустой набор N-грамм
+func NewNgramSet(n int) *NgramSet {
+	return &NgramSet{N: n}
+}
+
+// Хеш N-граммы; токены разделяются нулевым байтом
+func ngramHash(tokens []string) uint64 {
+	hash := fnv.New64a()
+	for i, token := range tokens {
+		if i > 0 {
+			hash.Write([]byte{0})
+		}
+		hash.Write([]byte(token))
+	}
+	return hash.Sum64()
+}
+
+// Токены без <start> и <end>
+func contentTokens(tokens []string) []string {
+	var content []string
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" {
+			content = append(content, token)
+		}
+	}
+	return content
+}
+
+// Число различных N-грамм; для отсутствующего набора 0
+func (s *NgramSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.Hashes)
+}
+
+// Добавляем N-граммы предложений
+func (s *NgramSet) Add(sentences [][]string) {
+	hashes := s.Hashes
+	for _, sentence := range sentences {
+		tokens := contentTokens(sentence)
+		for i := 0; i+s.N <= len(tokens); i++ {
+			hashes = append(hashes, ngramHash(tokens[i:i+s.N]))
+		}
+	}
+	s.Hashes = uniqueSorted(hashes)
+}
+
+// Объединяем с другим набором того же размера N-грамм
+func (s *NgramSet) Merge(other *NgramSet) {
+	s.Hashes = uniqueSorted(append(append([]uint64{}, s.Hashes...), other.Hashes...))
+}
+
+// Сортировка хешей с удалением повторов
+func uniqueSorted(hashes []uint64) []uint64 {
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	unique := hashes[:0]
+	for i, hash := range hashes {
+		if i == 0 || hash != hashes[i-1] {
+			unique = append(unique, hash)
+		}
+	}
+	return unique
+}
+
+// Встречается ли N-грамма в корпусе (с точностью до коллизий хеша)
+func (s *NgramSet) Contains(ngram []string) bool {
+	if len(ngram) != s.N {
+		return false
+	}
+	hash := ngramHash(ngram)
+	i := sort.Search(len(s.Hashes), func(i int) bool { return s.Hashes[i] >= hash })
+	return i < len(s.Hashes) && s.Hashes[i] == hash
+}
+
+// Проверка набора: размер N-грамм и упорядоченность хешей
+func (s *NgramSet) validate() error {
+	if s.N < 2 {
+		return fmt.Errorf("invalid novelty n-gram size %d", s.N)
+	}
+	for i := 1; i < len(s.Hashes); i++ {
+		if s.Hashes[i] <= s.Hashes[i-1] {
+			return fmt.Errorf("novelty n-gram hashes are not sorted")
+		}
+	}
+	return nil
+}
+
+// Самый длинный фрагмент токенов, дословно скопированный из корпуса, и доля
+// N-грамм, которых в корпусе нет. Фрагмент считается скопированным, если все
+// его N-граммы есть в корпусе; фрагменты короче N не учитываются. Текст
+// короче N ничего скопировать не может, его новизна равна 1
+func (s *NgramSet) Copied(tokens []string) (longest int, novelty float64) {
+	tokens = contentTokens(tokens)
+	windows, copied := 0, 0
+	run := 0
+	for i := 0; i+s.N <= len(tokens); i++ {
+		windows++
+		if !s.Contains(tokens[i : i+s.N]) {
+			run = 0
+			continue
+		}
+		copied++
+		if run == 0 {
+			run = s.N
+		} else {
+			run++
+		}
+		longest = max(longest, run)
+	}
+
+	if windows == 0 {
+		return 0, 1
+	}
+	return longest, 1 - float64(copied)/float64(windows)
+}
@@ -0,0 +1,42 @@
+package trainer
+
+import (
+	"sync"
+)
+
+// Параллельное обучение: предложения делятся на шарды, каждый шард
+// считается в собственных таблицах, затем таблицы сливаются по порядку шардов
+func (mc *MarkovChain) trainParallel(sentences [][]string, workers int) {
+	if workers > len(sentences) {
+		workers = len(sentences)
+	}
+
+	// Границы шардов w*n/workers: размеры отличаются не больше чем на одно
+	// предложение, и ни один шард не выходит за конец корпуса
+	shards := make([]*MarkovChain, workers)
+	n := len(sentences)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * n / workers
+		end := (w + 1) * n / workers
+
+		shard := &MarkovChain{Order: mc.Order, Backoff: mc.Backoff, Smoothing: mc.Smoothing}
+		shard.ensureTables()
+		shards[w] = shard
+
+		wg.Add(1)
+		go func(part [][]string) {
+			defer wg.Done()
+			shard.buildVocab(part)
+			for _, sentence := range part {
+				shard.processSentence(sentence)
+			}
+		}(sentences[start:end])
+	}
+	wg.Wait()
+
+	for _, shard := range shards {
+		mc.addCounts(shard, 1)
+	}
+}
@@ -0,0 +1,35 @@
+package trainer
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Параллельное обучение сохраняет тот же файл, что и последовательное:
+// для цепи одного порядка, цепи всех порядков и обратной цепи, а также
+// когда 10 предложений делятся на 8 шардов неравного размера
+func TestParallelTrainingMatchesSequential(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  TrainConfig
+		workers int
+	}{
+		{"single order", TrainConfig{Order: 3}, 4},
+		{"all orders", TrainConfig{Order: 3, Backoff: BackoffKatz}, 4},
+		{"backward", TrainConfig{Order: 2, Backward: true, MinFrequency: 1}, 4},
+		{"uneven shards", TrainConfig{Order: 3}, 8},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sequential, parallel := c.config, c.config
+			sequential.Workers = 1
+			parallel.Workers = c.workers
+
+			a := savedBytes(t, trainTestModel(t, sequential), "sequential.json")
+			b := savedBytes(t, trainTestModel(t, parallel), "parallel.json")
+			if !bytes.Equal(a, b) {
+				t.Fatalf("parallel training saved %d bytes that differ from %d sequential bytes", len(b), len(a))
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package trainer
+
+import (
+	"sort"
+)
+
+// Настройки прореживания модели
+type PruneConfig struct {
+	MinCount       int `json:"min_count"`        // Минимальное число переходов prefix -> suffix
+	MinPrefixCount int `json:"min_prefix_count"` // Минимальное суммарное число переходов из префикса
+	TopK           int `json:"top_k"`            // Сколько самых частых продолжений оставлять (0 — все)
+}
+
+// Размер модели до и после прореживания
+type PruneReport struct {
+	PrefixesBefore    int
+	PrefixesAfter     int
+	TransitionsBefore int
+	TransitionsAfter  int
+}
+
+// Нужно ли вообще прореживать модель
+func (config PruneConfig) enabled() bool {
+	return config.MinCount > 1 || config.MinPrefixCount > 1 || config.TopK > 0
+}
+
+// Удаляем редкие переходы и префиксы с недостаточной статистикой
+func (mc *MarkovChain) Prune(config PruneConfig) PruneReport {
+	report := PruneReport{PrefixesBefore: len(mc.Chain)}
+	for _, suffixes := range mc.Chain {
+		report.TransitionsBefore += len(suffixes)
+	}
+
+	unigrams := joinTokens(nil)
+	for prefix, suffixes := range mc.Chain {
+		// Униграммы нужны для отката и сглаживания, их не трогаем
+		if prefix == unigrams && mc.IsVariableOrder() {
+			continue
+		}
+
+		for suffix, count := range suffixes {
+			if count < config.MinCount {
+				delete(suffixes, suffix)
+			}
+		}
+
+		if config.TopK > 0 && len(suffixes) > config.TopK {
+			keepTopSuffixes(suffixes, config.TopK)
+		}
+
+		total := 0
+		for _, count := range suffixes {
+			total += count
+		}
+		if len(suffixes) == 0 || total < config.MinPrefixCount {
+			delete(mc.Chain, prefix)
+		}
+	}
+
+	mc.Sums = make(map[string]int)
+	mc.calculateSums()
+
+	// Обратная цепь прореживается с теми же порогами
+	if mc.Backward != nil {
+		mc.Backward.Prune(config)
+	}
+	if mc.Stats != nil {
+		mc.RecomputeStats()
+	}
+
+	training := &mc.Meta.Training
+	training.MinFrequency = max(training.MinFrequency, config.MinCount)
+	training.MinPrefixCount = max(training.MinPrefixCount, config.MinPrefixCount)
+	if config.TopK > 0 && (training.TopK == 0 || config.TopK < training.TopK) {
+		training.TopK = config.TopK
+	}
+
+	report.PrefixesAfter = len(mc.Chain)
+	for _, suffixes := range mc.Chain {
+		report.TransitionsAfter += len(suffixes)
+	}
+	return report
+}
+
+// Оставляем k самых частых продолжений; при равенстве — в алфавитном порядке
+func keepTopSuffixes(suffixes map[string]int, k int) {
+	ranked := make([]string, 0, len(suffixes))
+	for suffix := range suffixes {
+		ranked = append(ranked, suffix)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if suffixes[ranked[i]] != suffixes[ranked[j]] {
+			return suffixes[ranked[i]] > suffixes[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	for _, suffix := range ranked[k:] {
+		delete(suffixes, suffix)
+	}
+}
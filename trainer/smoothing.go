@@ -0,0 +1,298 @@
+package trainer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Методы сглаживания вероятностей
+const (
+	SmoothingAddK       = "addk"       // Добавление k к каждому счетчику
+	SmoothingWittenBell = "wittenbell" // Интерполяция Уиттена-Белла
+	SmoothingKneserNey  = "kneserney"  // Интерполированный модифицированный Кнезер-Ней
+)
+
+// Параметры сглаживания, сохраняемые в модели
+type Smoothing struct {
+	Method    string             `json:"method"`              // Метод сглаживания
+	K         float64            `json:"k,omitempty"`         // Добавка для add-k
+	Discounts map[int][3]float64 `json:"discounts,omitempty"` // Кнезер-Ней: порядок -> D1, D2, D3+
+}
+
+// Таблицы Кнезера-Нея, восстанавливаемые из цепи при загрузке
+type knTables struct {
+	counts map[string]map[string]int // Скорректированные счетчики: prefix -> {suffix -> count}
+	sums   map[string]int            // Суммы скорректированных счетчиков по префиксу
+	types  map[string][3]int         // Число продолжений со счетчиком 1, 2 и 3+
+}
+
+// Проверка параметров сглаживания
+func (s *Smoothing) validate() error {
+	if s == nil {
+		return nil
+	}
+	switch s.Method {
+	case SmoothingAddK:
+		if s.K <= 0 {
+			return fmt.Errorf("add-k smoothing requires positive k, got %g", s.K)
+		}
+	case SmoothingWittenBell, SmoothingKneserNey:
+	default:
+		return fmt.Errorf("unknown smoothing %q (expected %q, %q or %q)",
+			s.Method, SmoothingAddK, SmoothingWittenBell, SmoothingKneserNey)
+	}
+	return nil
+}
+
+// Нужны ли методу счетчики младших порядков
+func (s *Smoothing) needsLowerOrders() bool {
+	return s != nil && (s.Method == SmoothingWittenBell || s.Method == SmoothingKneserNey)
+}
+
+// Размер словаря: все токены плюс <end>
+func (mc *MarkovChain) vocabularySize() int {
+	return len(mc.Vocab) + 1
+}
+
+// Входит ли токен в словарь модели
+func (mc *MarkovChain) inVocabulary(token string) bool {
+	if token == "<end>" {
+		return true
+	}
+	_, exists := mc.Vocab[token]
+	return exists
+}
+
+// Сглаженная вероятность токена после контекста. Для токенов из словаря
+// вероятность всегда положительна, для неизвестных токенов возвращается 0.
+// Без заданного сглаживания используется Katz для моделей с откатом Katz,
+// таблицы ARPA для импортированных моделей и add-one (Лаплас) для остальных
+func (mc *MarkovChain) Probability(context []string, token string) float64 {
+	if !mc.inVocabulary(token) {
+		return 0
+	}
+	if len(context) > mc.Order-1 {
+		context = context[len(context)-mc.Order+1:]
+	}
+
+	if mc.Smoothing == nil {
+		switch mc.Backoff {
+		case BackoffKatz:
+			return mc.katzProbability(context, token)
+		case BackoffARPA:
+			return mc.arpaProbability(context, token)
+		default:
+			return mc.addKProbability(context, token, 1)
+		}
+	}
+	switch mc.Smoothing.Method {
+	case SmoothingWittenBell:
+		return mc.wittenBellProbability(context, token)
+	case SmoothingKneserNey:
+		return mc.kneserNeyProbability(context, token)
+	default:
+		return mc.addKProbability(context, token, mc.Smoothing.K)
+	}
+}
+
+// Add-k: (c(h,w) + k) / (c(h) + k*V)
+func (mc *MarkovChain) addKProbability(context []string, token string, k float64) float64 {
+	prefix := joinTokens(context)
+	vocabSize := float64(mc.vocabularySize())
+
+	return (float64(mc.Chain[prefix][token]) + k) / (float64(mc.Sums[prefix]) + k*vocabSize)
+}
+
+// Уиттен-Белл: (c(h,w) + T(h) * P(w|h')) / (c(h) + T(h)), T(h) — число разных продолжений
+func (mc *MarkovChain) wittenBellProbability(context []string, token string) float64 {
+	var lower float64
+	if len(context) == 0 {
+		lower = 1 / float64(mc.vocabularySize())
+	} else {
+		lower = mc.wittenBellProbability(context[1:], token)
+	}
+
+	prefix := joinTokens(context)
+	total := float64(mc.Sums[prefix])
+	types := float64(len(mc.Chain[prefix]))
+	if total == 0 {
+		return lower
+	}
+
+	return (float64(mc.Chain[prefix][token]) + types*lower) / (total + types)
+}
+
+// Интерполированный модифицированный Кнезер-Ней
+func (mc *MarkovChain) kneserNeyProbability(context []string, token string) float64 {
+	var lower float64
+	if len(context) == 0 {
+		lower = 1 / float64(mc.vocabularySize())
+	} else {
+		lower = mc.kneserNeyProbability(context[1:], token)
+	}
+
+	prefix := joinTokens(context)
+	total := float64(mc.kn.sums[prefix])
+	if total == 0 {
+		return lower
+	}
+
+	discounts := mc.Smoothing.Discounts[len(context)+1]
+	count := mc.kn.counts[prefix][token]
+	discounted := 0.0
+	if count > 0 {
+		discounted = max(float64(count)-discountFor(discounts, count), 0) / total
+	}
+
+	types := mc.kn.types[prefix]
+	gamma := (discounts[0]*float64(types[0]) + discounts[1]*float64(types[1]) + discounts[2]*float64(types[2])) / total
+
+	return discounted + gamma*lower
+}
+
+// Дисконт для счетчика: D1, D2 или D3+
+func discountFor(discounts [3]float64, count int) float64 {
+	return discounts[min(count, 3)-1]
+}
+
+// Оценка параметров сглаживания по текущим счетчикам
+func (mc *MarkovChain) estimateSmoothing() {
+	if mc.Smoothing == nil || mc.Smoothing.Method != SmoothingKneserNey {
+		mc.kn = nil
+		return
+	}
+
+	mc.buildKneserNeyTables()
+	mc.Smoothing.Discounts = make(map[int][3]float64)
+
+	countOfCounts := make(map[int][5]int)
+	for prefix, suffixes := range mc.kn.counts {
+		n := prefixLength(prefix) + 1
+		nr := countOfCounts[n]
+		for _, count := range suffixes {
+			if count <= 4 {
+				nr[count]++
+			}
+		}
+		countOfCounts[n] = nr
+	}
+
+	for n, nr := range countOfCounts {
+		mc.Smoothing.Discounts[n] = modifiedKneserNeyDiscounts(nr)
+	}
+}
+
+// Восстановление производных таблиц по сохраненным параметрам
+func (mc *MarkovChain) prepareSmoothing() {
+	if mc.Smoothing == nil || mc.Smoothing.Method != SmoothingKneserNey {
+		mc.kn = nil
+		return
+	}
+	mc.buildKneserNeyTables()
+}
+
+// Дисконты Чена-Гудмана: Y = n1/(n1+2n2), Dk = k - (k+1)Y n(k+1)/nk;
+// при недостатке статистики используются 0.5, 1.0 и 1.5
+func modifiedKneserNeyDiscounts(nr [5]int) [3]float64 {
+	discounts := [3]float64{0.5, 1.0, 1.5}
+	if nr[1] == 0 || nr[2] == 0 {
+		return discounts
+	}
+
+	y := float64(nr[1]) / float64(nr[1]+2*nr[2])
+	for k := 1; k <= 3; k++ {
+		if nr[k] == 0 || nr[k+1] == 0 {
+			continue
+		}
+		d := float64(k) - float64(k+1)*y*float64(nr[k+1])/float64(nr[k])
+		if d > 0 && d < float64(k) {
+			discounts[k-1] = d
+		}
+	}
+	return discounts
+}
+
+// Скорректированные счетчики: для старшего порядка — исходные, для младших —
+// число разных левых соседей; N-граммы с <start> в начале сохраняют исходный счетчик
+func (mc *MarkovChain) buildKneserNeyTables() {
+	tables := &knTables{
+		counts: make(map[string]map[string]int),
+		sums:   make(map[string]int),
+		types:  make(map[string][3]int),
+	}
+
+	add := func(prefix, suffix string, count int) {
+		if tables.counts[prefix] == nil {
+			tables.counts[prefix] = make(map[string]int)
+		}
+		tables.counts[prefix][suffix] += count
+	}
+
+	for prefix, suffixes := range mc.Chain {
+		tokens := prefixTokens(prefix)
+
+		for suffix, count := range suffixes {
+			if len(tokens) == mc.Order-1 || (len(tokens) > 0 && tokens[0] == "<start>") {
+				add(prefix, suffix, count)
+			}
+			if len(tokens) > 0 {
+				add(joinTokens(tokens[1:]), suffix, 1)
+			}
+		}
+	}
+
+	for prefix, suffixes := range tables.counts {
+		var types [3]int
+		for _, count := range suffixes {
+			tables.sums[prefix] += count
+			types[min(count, 3)-1]++
+		}
+		tables.types[prefix] = types
+	}
+
+	mc.kn = tables
+}
+
+// Распределение следующего токена по сглаженным вероятностям. Кандидаты —
+// продолжения всех известных непустых контекстов, иначе весь словарь униграмм
+func (mc *MarkovChain) smoothedNextTokens(prefix []string) map[string]float64 {
+	context := prefix
+	if len(context) > mc.Order-1 {
+		context = context[len(context)-mc.Order+1:]
+	}
+
+	candidates := make(map[string]bool)
+	if !mc.IsVariableOrder() {
+		for suffix := range mc.Chain[joinTokens(context)] {
+			candidates[suffix] = true
+		}
+	} else {
+		for lower := context; len(lower) > 0; lower = lower[1:] {
+			for suffix := range mc.Chain[joinTokens(lower)] {
+				candidates[suffix] = true
+			}
+		}
+		if len(candidates) == 0 {
+			for suffix := range mc.Chain[joinTokens(nil)] {
+				candidates[suffix] = true
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	probabilities := make(map[string]float64)
+	for candidate := range candidates {
+		probabilities[candidate] = mc.Probability(context, candidate)
+	}
+	return probabilities
+}
+
+// Разбор ключа префикса обратно в токены
+func prefixTokens(prefix string) []string {
+	if len(prefix) < 2 {
+		return nil
+	}
+	return strings.Fields(prefix[1 : len(prefix)-1])
+}
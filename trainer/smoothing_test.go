@@ -0,0 +1,41 @@
+package trainer
+
+import (
+	"maps"
+	"math"
+	"testing"
+)
+
+// Контексты для проверки распределений: все префиксы цепи и неизвестный
+func testContexts(mc *MarkovChain) [][]string {
+	contexts := [][]string{{"неизвестное", "слово"}}
+	for prefix := range mc.Chain {
+		contexts = append(contexts, prefixTokens(prefix))
+	}
+	return contexts
+}
+
+// При любом сглаживании вероятности продолжений контекста положительны
+// и в сумме дают 1; модель без сглаживания оценивается по add-one
+func TestProbabilitySumsToOne(t *testing.T) {
+	configs := map[string]TrainConfig{"addone": {Order: 3}}
+	maps.Copy(configs, normalizedConfigs)
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			mc := trainTestModel(t, config)
+			for _, context := range testContexts(mc) {
+				sum := mc.Probability(context, "<end>")
+				for token := range mc.Vocab {
+					p := mc.Probability(context, token)
+					if p <= 0 {
+						t.Fatalf("P(%s | %v) = %g, expected a positive probability", token, context, p)
+					}
+					sum += p
+				}
+				if math.Abs(sum-1) > 1e-9 {
+					t.Fatalf("probabilities after %v sum to %.12f", context, sum)
+				}
+			}
+		})
+	}
+}
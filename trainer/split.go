@@ -0,0 +1,172 @@
+package trainer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Документ корпуса: токенизированные предложения одного файла
+type Document struct {
+	Name       string
+	Sentences  [][]string
+	Paragraphs [][]string // Абзацы документа для тематической модели (необязательно)
+}
+
+// Способы разбиения корпуса
+const (
+	SplitBySentence = "sentence"
+	SplitByDocument = "document"
+)
+
+// Настройки разбиения на обучающую, валидационную и тестовую части
+type SplitConfig struct {
+	Train      float64 `json:"train"`      // Доля обучающей части
+	Validation float64 `json:"validation"` // Доля валидационной части
+	Test       float64 `json:"test"`       // Доля тестовой части
+	By         string  `json:"by"`         // sentence или document
+	Seed       int64   `json:"seed"`       // Зерно перемешивания
+}
+
+// Результат разбиения корпуса
+type Split struct {
+	Train      []Document
+	Validation []Document
+	Test       []Document
+}
+
+// Разбор долей вида "0.8,0.1,0.1"
+func ParseSplitRatios(value string) (train, validation, test float64, err error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("split must have three comma-separated ratios, got %q", value)
+	}
+
+	ratios := make([]float64, 3)
+	for i, part := range parts {
+		ratios[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid split ratio %q: %w", part, err)
+		}
+	}
+	return ratios[0], ratios[1], ratios[2], nil
+}
+
+// Детерминированное разбиение корпуса. Порядок предложений внутри каждой
+// части совпадает с исходным, поэтому одинаковое зерно дает одинаковые части.
+// При разбиении по предложениям абзацы документов не переносятся: их
+// предложения могут попасть в разные части
+func SplitCorpus(documents []Document, config SplitConfig) (Split, error) {
+	total := config.Train + config.Validation + config.Test
+	if config.Train <= 0 || config.Validation < 0 || config.Test < 0 || total <= 0 {
+		return Split{}, fmt.Errorf("invalid split ratios %g/%g/%g", config.Train, config.Validation, config.Test)
+	}
+	rng := rand.New(rand.NewSource(config.Seed))
+
+	switch config.By {
+	case SplitByDocument:
+		if len(documents) < 2 {
+			return Split{}, fmt.Errorf("splitting by document needs at least 2 documents, got %d", len(documents))
+		}
+		parts := assignParts(len(documents), config, total, rng)
+
+		var split Split
+		for i, document := range documents {
+			part := split.part(parts[i])
+			*part = append(*part, document)
+		}
+		return split, nil
+
+	case SplitBySentence, "":
+		type position struct{ document, sentence int }
+		var positions []position
+		for d, document := range documents {
+			for s := range document.Sentences {
+				positions = append(positions, position{d, s})
+			}
+		}
+		parts := assignParts(len(positions), config, total, rng)
+
+		var split Split
+		byPart := [3][]Document{}
+		for p := range byPart {
+			byPart[p] = make([]Document, len(documents))
+			for d, document := range documents {
+				byPart[p][d].Name = document.Name
+			}
+		}
+		for i, pos := range positions {
+			sentence := documents[pos.document].Sentences[pos.sentence]
+			target := &byPart[parts[i]][pos.document]
+			target.Sentences = append(target.Sentences, sentence)
+		}
+		for p := range byPart {
+			part := split.part(p)
+			for _, document := range byPart[p] {
+				if len(document.Sentences) > 0 {
+					*part = append(*part, document)
+				}
+			}
+		}
+		return split, nil
+
+	default:
+		return Split{}, fmt.Errorf("unknown split mode %q (expected %q or %q)", config.By, SplitBySentence, SplitByDocument)
+	}
+}
+
+// Назначаем каждому из n элементов часть: 0 — обучение, 1 — валидация, 2 — тест
+func assignParts(n int, config SplitConfig, total float64, rng *rand.Rand) []int {
+	order := rng.Perm(n)
+
+	validation := partSize(n, config.Validation/total)
+	test := partSize(n, config.Test/total)
+	for validation+test >= n && test > 0 {
+		test--
+	}
+	for validation+test >= n && validation > 0 {
+		validation--
+	}
+
+	parts := make([]int, n)
+	for rank, item := range order {
+		switch {
+		case rank < validation:
+			parts[item] = 1
+		case rank < validation+test:
+			parts[item] = 2
+		}
+	}
+	return parts
+}
+
+// Размер части: не меньше одного элемента, если доля положительна
+func partSize(n int, ratio float64) int {
+	if ratio <= 0 {
+		return 0
+	}
+	return max(1, int(math.Round(float64(n)*ratio)))
+}
+
+// Часть разбиения по номеру
+func (s *Split) part(p int) *[]Document {
+	switch p {
+	case 1:
+		return &s.Validation
+	case 2:
+		return &s.Test
+	default:
+		return &s.Train
+	}
+}
+
+// Все предложения документов подряд
+func Sentences(documents []Document) [][]string {
+	var sentences [][]string
+	for _, document := range documents {
+		sentences = append(sentences, document.Sentences...)
+	}
+	return sentences
+}
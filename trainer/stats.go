@@ -0,0 +1,132 @@
+package trainer
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Статистика токена, вычисляемая один раз при обучении
+type TokenStats struct {
+	Frequency int     `json:"frequency"` // Частота токена в корпусе
+	Contexts  int     `json:"contexts"`  // Число разных контекстов, в которых встречается токен
+	Entropy   float64 `json:"entropy"`   // Энтропия Шеннона распределения контекстов
+	Thematic  float64 `json:"thematic"`  // Тематичность: 1 / (энтропия + 0.1)
+	IDF       float64 `json:"idf"`       // Обратная частота по предложениям индекса (BM25)
+}
+
+// Таблицы статистики токенов, сохраняемые в модели
+type Stats struct {
+	Tokens     map[string]TokenStats `json:"tokens"`
+	MinEntropy float64               `json:"min_entropy"`
+	MaxEntropy float64               `json:"max_entropy"`
+}
+
+// Вычисляем статистику токенов по цепи, словарю и индексу. Контекст токена —
+// неупорядоченный набор токенов префикса длины Order-1, в котором токен
+// встречается в префиксе или продолжении
+func (mc *MarkovChain) ComputeStats() *Stats {
+	tokenContexts := make(map[string]map[string]int)
+	addContext := func(token, context string) {
+		if tokenContexts[token] == nil {
+			tokenContexts[token] = make(map[string]int)
+		}
+		tokenContexts[token][context]++
+	}
+
+	for prefix, suffixes := range mc.Chain {
+		tokens := prefixTokens(prefix)
+		if len(tokens) != mc.Order-1 {
+			continue
+		}
+
+		sorted := append([]string{}, tokens...)
+		sort.Strings(sorted)
+		context := strings.Join(sorted, "|")
+
+		for _, token := range tokens {
+			addContext(token, context)
+		}
+		for suffix := range suffixes {
+			addContext(suffix, context)
+		}
+	}
+
+	stats := &Stats{Tokens: make(map[string]TokenStats)}
+	first := true
+	for token, contexts := range tokenContexts {
+		entropy := contextEntropy(contexts)
+		stats.Tokens[token] = TokenStats{
+			Frequency: mc.Vocab[token],
+			Contexts:  len(contexts),
+			Entropy:   entropy,
+			Thematic:  1 / (entropy + 0.1),
+			IDF:       mc.indexIDF(token),
+		}
+
+		if first || entropy < stats.MinEntropy {
+			stats.MinEntropy = entropy
+		}
+		if first || entropy > stats.MaxEntropy {
+			stats.MaxEntropy = entropy
+		}
+		first = false
+	}
+
+	return stats
+}
+
+// Пересчитываем и сохраняем в модели статистику токенов
+func (mc *MarkovChain) RecomputeStats() {
+	mc.Stats = mc.ComputeStats()
+}
+
+// Энтропия Шеннона распределения контекстов; счетчики суммируются
+// в порядке ключей, чтобы результат не зависел от обхода словаря
+func contextEntropy(contexts map[string]int) float64 {
+	keys := make([]string, 0, len(contexts))
+	total := 0
+	for context, count := range contexts {
+		keys = append(keys, context)
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Strings(keys)
+
+	entropy := 0.0
+	for _, context := range keys {
+		probability := float64(contexts[context]) / float64(total)
+		entropy -= probability * math.Log2(probability)
+	}
+	return entropy
+}
+
+// IDF токена по индексу; для неиндексируемых токенов (знаков препинания) — 0
+func (mc *MarkovChain) indexIDF(token string) float64 {
+	if mc.Index == nil || len(mc.Index.Postings[token]) == 0 {
+		return 0
+	}
+	return mc.Index.IDF(token)
+}
+
+// Самые тематические токены: по убыванию тематичности, затем по алфавиту
+func (s *Stats) TopThematic(limit int) []string {
+	tokens := make([]string, 0, len(s.Tokens))
+	for token := range s.Tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := s.Tokens[tokens[i]], s.Tokens[tokens[j]]
+		if a.Thematic != b.Thematic {
+			return a.Thematic > b.Thematic
+		}
+		return tokens[i] < tokens[j]
+	})
+
+	if limit > 0 && len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens
+}
@@ -0,0 +1,88 @@
+package trainer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Настройки сохранения модели
+type SaveOptions struct {
+	Backups int // Количество хранимых резервных копий (model.json.1 ... model.json.N)
+}
+
+// Атомарная запись файла: временный файл, fsync, переименование
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	return syncDir(dir)
+}
+
+// Сбрасываем на диск запись каталога, чтобы переименование пережило сбой
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	// На некоторых платформах fsync каталога не поддерживается
+	_ = d.Sync()
+	return nil
+}
+
+// Сдвигаем резервные копии: path.N-1 -> path.N, ..., path -> path.1
+func rotateBackups(path string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := backups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", path, i)
+		to := fmt.Sprintf("%s.%d", path, i+1)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to rotate backup %s: %w", from, err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read current model for backup: %w", err)
+	}
+	return writeFileAtomic(path+".1", data, 0644)
+}
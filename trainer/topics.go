@@ -0,0 +1,368 @@
+package trainer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"markmach/retrieval"
+)
+
+// Параметры тематической модели по умолчанию
+const (
+	topicAlpha          = 0.1 // Априорная плотность тем в документе
+	topicBeta           = 0.01
+	topicIterations     = 200
+	topicTopWords       = 10
+	topicInferSteps     = 20  // Итерации вывода смеси тем для нового текста
+	topicMaxDocumentPct = 0.5 // Слова, встречающиеся в большей доле абзацев, считаются служебными
+)
+
+// Тематическая модель корпуса: LDA, обученная сэмплированием Гиббса
+type TopicModel struct {
+	Alpha      float64          `json:"alpha"`
+	Beta       float64          `json:"beta"`
+	Iterations int              `json:"iterations"`
+	Seed       int64            `json:"seed"`
+	Words      map[string][]int `json:"words"`    // Слово -> число его вхождений, отнесенных к каждой теме
+	Totals     []int            `json:"totals"`   // Число слов, отнесенных к теме
+	Mixtures   [][]float64      `json:"mixtures"` // Предложение индекса -> смесь тем
+}
+
+// Число тем
+func (tm *TopicModel) Count() int {
+	return len(tm.Totals)
+}
+
+// Обучение тематической модели на абзацах документов. Если абзацев нет
+// (например, при обучении через Train), документами LDA служат единицы
+// обучения. Разбиение по предложениям абзацы не сохраняет, поэтому команда
+// train не сочетает его с --topics
+func (mc *MarkovChain) trainTopics(documents []Document) {
+	var texts [][]string
+	for _, document := range documents {
+		if len(document.Paragraphs) > 0 {
+			texts = append(texts, document.Paragraphs...)
+		} else {
+			texts = append(texts, document.Sentences...)
+		}
+	}
+
+	iterations := mc.config.TopicIterations
+	if iterations <= 0 {
+		iterations = topicIterations
+	}
+	mc.TopicModel = fitLDA(topicDocuments(texts), mc.config.Topics, iterations, mc.config.TopicSeed)
+	mc.Topics = mc.TopicModel.topWords(topicTopWords)
+	mc.Meta.Training.Topics = mc.TopicModel.Count()
+
+	fmt.Printf("Topic model: %d topics over %d texts, %d words\n", mc.TopicModel.Count(), len(texts), len(mc.TopicModel.Words))
+	for topic := 0; topic < mc.TopicModel.Count(); topic++ {
+		fmt.Printf("  topic %d: %v\n", topic, mc.Topics[strconv.Itoa(topic)])
+	}
+}
+
+// Слова документов, пригодные для тематической модели: без служебных
+// токенов, знаков препинания, коротких и слишком частых слов
+func topicDocuments(texts [][]string) [][]string {
+	documentFrequency := make(map[string]int)
+	for _, text := range texts {
+		seen := make(map[string]bool)
+		for _, token := range text {
+			if isTopicWord(token) && !seen[token] {
+				seen[token] = true
+				documentFrequency[token]++
+			}
+		}
+	}
+
+	limit := len(texts)
+	if len(texts) >= 10 {
+		limit = int(float64(len(texts)) * topicMaxDocumentPct)
+	}
+
+	documents := make([][]string, len(texts))
+	for i, text := range texts {
+		for _, token := range text {
+			if isTopicWord(token) && documentFrequency[token] <= limit {
+				documents[i] = append(documents[i], token)
+			}
+		}
+	}
+	return documents
+}
+
+// Может ли токен быть тематическим словом
+func isTopicWord(token string) bool {
+	return token != "<start>" && token != "<end>" && !isPunctuation(token) && utf8.RuneCountInString(token) >= 3
+}
+
+// LDA со схлопнутым сэмплированием Гиббса. Слова нумеруются по алфавиту,
+// а генератор случайных чисел задается зерном, поэтому результат воспроизводим
+func fitLDA(documents [][]string, topics, iterations int, seed int64) *TopicModel {
+	var vocab []string
+	ids := make(map[string]int)
+	for _, document := range documents {
+		for _, word := range document {
+			if _, exists := ids[word]; !exists {
+				ids[word] = 0
+				vocab = append(vocab, word)
+			}
+		}
+	}
+	sort.Strings(vocab)
+	for id, word := range vocab {
+		ids[word] = id
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	wordTopic := make([][]int, len(vocab))
+	for id := range wordTopic {
+		wordTopic[id] = make([]int, topics)
+	}
+	documentTopic := make([][]int, len(documents))
+	totals := make([]int, topics)
+	assignments := make([][]int, len(documents))
+
+	for d, document := range documents {
+		documentTopic[d] = make([]int, topics)
+		assignments[d] = make([]int, len(document))
+		for i, word := range document {
+			topic := rng.Intn(topics)
+			assignments[d][i] = topic
+			wordTopic[ids[word]][topic]++
+			documentTopic[d][topic]++
+			totals[topic]++
+		}
+	}
+
+	vocabBeta := float64(len(vocab)) * topicBeta
+	weights := make([]float64, topics)
+	for iteration := 0; iteration < iterations; iteration++ {
+		for d, document := range documents {
+			for i, word := range document {
+				id := ids[word]
+				topic := assignments[d][i]
+				wordTopic[id][topic]--
+				documentTopic[d][topic]--
+				totals[topic]--
+
+				total := 0.0
+				for k := range weights {
+					weights[k] = (float64(documentTopic[d][k]) + topicAlpha) *
+						(float64(wordTopic[id][k]) + topicBeta) / (float64(totals[k]) + vocabBeta)
+					total += weights[k]
+				}
+				topic = sampleIndex(weights, rng.Float64()*total)
+
+				assignments[d][i] = topic
+				wordTopic[id][topic]++
+				documentTopic[d][topic]++
+				totals[topic]++
+			}
+		}
+	}
+
+	model := &TopicModel{
+		Alpha:      topicAlpha,
+		Beta:       topicBeta,
+		Iterations: iterations,
+		Seed:       seed,
+		Words:      make(map[string][]int, len(vocab)),
+		Totals:     totals,
+	}
+	for id, word := range vocab {
+		model.Words[word] = wordTopic[id]
+	}
+	return model
+}
+
+// Индекс, на который попадает значение r при накоплении весов
+func sampleIndex(weights []float64, r float64) int {
+	for i, weight := range weights {
+		r -= weight
+		if r <= 0 {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
+
+// Самые вероятные слова каждой темы; при равных счетчиках — по алфавиту
+func (tm *TopicModel) topWords(limit int) map[string][]string {
+	words := make([]string, 0, len(tm.Words))
+	for word := range tm.Words {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	topics := make(map[string][]string, tm.Count())
+	for topic := 0; topic < tm.Count(); topic++ {
+		ranked := append([]string{}, words...)
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return tm.Words[ranked[i]][topic] > tm.Words[ranked[j]][topic]
+		})
+
+		var top []string
+		for _, word := range ranked {
+			if len(top) == limit || tm.Words[word][topic] == 0 {
+				break
+			}
+			top = append(top, word)
+		}
+		topics[strconv.Itoa(topic)] = top
+	}
+	return topics
+}
+
+// Вероятность слова в теме
+func (tm *TopicModel) wordProbability(word string, topic int) float64 {
+	return (float64(tm.Words[word][topic]) + tm.Beta) / (float64(tm.Totals[topic]) + float64(len(tm.Words))*tm.Beta)
+}
+
+// Смесь тем для текста: фиксированное число шагов EM по словам текста
+// при неизменных распределениях слов в темах. Текст без известных
+// модели слов получает равномерную смесь
+func (tm *TopicModel) Infer(tokens []string) []float64 {
+	topics := tm.Count()
+	mixture := make([]float64, topics)
+	for k := range mixture {
+		mixture[k] = 1 / float64(topics)
+	}
+
+	var probabilities [][]float64
+	for _, token := range tokens {
+		if _, exists := tm.Words[token]; !exists {
+			continue
+		}
+		probability := make([]float64, topics)
+		for k := range probability {
+			probability[k] = tm.wordProbability(token, k)
+		}
+		probabilities = append(probabilities, probability)
+	}
+	if len(probabilities) == 0 {
+		return mixture
+	}
+
+	counts := make([]float64, topics)
+	for step := 0; step < topicInferSteps; step++ {
+		for k := range counts {
+			counts[k] = 0
+		}
+		for _, probability := range probabilities {
+			total := 0.0
+			for k := range probability {
+				total += mixture[k] * probability[k]
+			}
+			for k := range probability {
+				counts[k] += mixture[k] * probability[k] / total
+			}
+		}
+		norm := float64(len(probabilities)) + float64(topics)*tm.Alpha
+		for k := range mixture {
+			mixture[k] = (counts[k] + tm.Alpha) / norm
+		}
+	}
+	return mixture
+}
+
+// Добавляем смеси тем для новых предложений индекса; значения округляются,
+// чтобы файл модели не разрастался
+func (tm *TopicModel) addMixtures(sentences [][]string) {
+	for _, sentence := range sentences {
+		mixture := tm.Infer(sentence)
+		for k := range mixture {
+			mixture[k] = math.Round(mixture[k]*1e4) / 1e4
+		}
+		tm.Mixtures = append(tm.Mixtures, mixture)
+	}
+}
+
+// Насколько слово относится к темам смеси: сумма вероятностей тем слова,
+// взвешенных долями смеси. Для неизвестных слов — 0
+func (tm *TopicModel) Affinity(word string, mixture []float64) float64 {
+	counts, exists := tm.Words[word]
+	if !exists {
+		return 0
+	}
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	affinity := 0.0
+	for k, count := range counts {
+		affinity += mixture[k] * float64(count) / float64(total)
+	}
+	return affinity
+}
+
+// Сходство смесей тем (скалярное произведение)
+func TopicSimilarity(a, b []float64) float64 {
+	similarity := 0.0
+	for k := range min(len(a), len(b)) {
+		similarity += a[k] * b[k]
+	}
+	return similarity
+}
+
+// Преобладающая тема смеси и ее доля
+func DominantTopic(mixture []float64) (int, float64) {
+	best := 0
+	for k := range mixture {
+		if mixture[k] > mixture[best] {
+			best = k
+		}
+	}
+	if len(mixture) == 0 {
+		return -1, 0
+	}
+	return best, mixture[best]
+}
+
+// Поиск предложений, как Search, но с учетом темы вопроса: оценка BM25
+// умножается на (1 + сходство смеси предложения со смесью вопроса)
+func (mc *MarkovChain) SearchTopic(keywords []string, mixture []float64, limit int) []string {
+	var sentences []string
+	for _, result := range mc.SearchTopicResults(keywords, mixture, limit) {
+		sentences = append(sentences, result.Document.Text)
+	}
+	return sentences
+}
+
+// Найденные предложения с номерами и положением в документах, как у
+// SearchTopic; оценка результата уже учитывает тему вопроса
+func (mc *MarkovChain) SearchTopicResults(keywords []string, mixture []float64, limit int) []retrieval.Result {
+	results := mc.Index.Search(retrieval.Query{Terms: keywords}, 0)
+	if mc.TopicModel != nil && mixture != nil {
+		for i, result := range results {
+			if result.Doc < len(mc.TopicModel.Mixtures) {
+				results[i].Score *= 1 + TopicSimilarity(mc.TopicModel.Mixtures[result.Doc], mixture)
+			}
+		}
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Score > results[j].Score
+		})
+	}
+
+	seen := make(map[string]bool)
+	var unique []retrieval.Result
+	for _, result := range results {
+		if len(unique) >= limit {
+			break
+		}
+		if !seen[result.Document.Text] {
+			seen[result.Document.Text] = true
+			unique = append(unique, result)
+		}
+	}
+	return unique
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"sort"
+
+	"markmach/retrieval"
+	"markmach/tokenizer"
 )
 
 // Представление цепи Маркова
@@ -12,79 +14,203 @@ type MarkovChain struct {
 	Order  int                       // Порядок цепи (N)
 	Chain  map[string]map[string]int // Цепь: prefix -> {suffix -> count}
 	Sums   map[string]int            // Суммы для быстрого расчета вероятностей
-	Index  map[string][]string       // Инвертированный индекс: слово -> предложения
+	Index  *retrieval.Index          // Поисковый индекс предложений корпуса
 	Vocab  map[string]int            // Словарь токенов с частотами
-	Topics map[string][]string
+	Topics map[string][]string       // Тема -> самые вероятные слова
+	Meta   *Metadata                 // Метаданные: версия формата, настройки, корпус
+
+	Backoff   string       // Стратегия отката; если задана, цепь хранит все порядки от 1 до N
+	Smoothing *Smoothing   // Параметры сглаживания вероятностей
+	ARPA      *ARPATables  // Вероятности импортированной ARPA-модели
+	Backward  *MarkovChain // Обратная цепь (справа налево) для генерации вокруг ключевого слова
+	Stats     *Stats       // Статистика токенов: энтропия, тематичность, IDF
+
+	TopicModel *TopicModel // Тематическая модель корпуса и смеси тем предложений индекса
+	Ngrams     *NgramSet   // Хешированные N-граммы корпуса для защиты от дословного копирования
+
+	config        TrainConfig       // Настройки текущего обучения
+	katzDiscounts map[int][]float64 // Дисконты Katz: порядок -> счетчик -> коэффициент
+	kn            *knTables         // Скорректированные счетчики Кнезера-Нея
 }
 
 // Настройки обучения
 type TrainConfig struct {
-	Order        int    // Порядок цепи (N-граммы)
-	MinFrequency int    // Минимальная частота токена
-	SaveModel    bool   // Сохранять модель на диск
-	ModelPath    string // Путь для сохранения модели
+	Order        int              // Порядок цепи (N-граммы)
+	MinFrequency int              // Минимальная частота перехода prefix -> suffix
+	SaveModel    bool             // Сохранять модель на диск
+	ModelPath    string           // Путь для сохранения модели
+	Tokenizer    tokenizer.Config // Настройки токенизатора корпуса
+	Unit         string           // Единица обучения: sentences, paragraphs или text
+	Workers      int              // Количество параллельных обработчиков (0 или 1 — последовательно)
+	MinPrefix    int              // Минимальное число переходов из префикса
+	TopK         int              // Сколько самых частых продолжений оставлять у префикса (0 — все)
+	Backoff      string           // Стратегия отката: "", "stupid" или "katz"
+	Smoothing    string           // Сглаживание: "", "addk", "wittenbell" или "kneserney"
+	SmoothingK   float64          // Добавка для add-k
+	Backward     bool             // Обучать также обратную цепь
+
+	Topics          int   // Число тем LDA (0 — без тематической модели)
+	TopicIterations int   // Число проходов сэмплирования Гиббса
+	TopicSeed       int64 // Зерно сэмплирования тем
+
+	NoveltyNGram int // Длина N-грамм корпуса для проверки копирования (0 — не строить набор)
+}
+
+// Параметры сглаживания, заданные при обучении
+func (config TrainConfig) smoothing() *Smoothing {
+	switch config.Smoothing {
+	case "":
+		return nil
+	case SmoothingAddK:
+		return &Smoothing{Method: config.Smoothing, K: config.SmoothingK}
+	default:
+		return &Smoothing{Method: config.Smoothing}
+	}
+}
+
+// Настройки прореживания, заданные при обучении
+func (config TrainConfig) pruneConfig() PruneConfig {
+	return PruneConfig{
+		MinCount:       config.MinFrequency,
+		MinPrefixCount: config.MinPrefix,
+		TopK:           config.TopK,
+	}
 }
 
 // Создание нового "тренера" цепи Маркова
 func NewMarkovTrainer(config TrainConfig) *MarkovChain {
 	return &MarkovChain{
-		Order: config.Order,
-		Chain: make(map[string]map[string]int),
-		Sums:  make(map[string]int),
-		Index: make(map[string][]string),
-		Vocab: make(map[string]int),
+		Order:     config.Order,
+		Chain:     make(map[string]map[string]int),
+		Sums:      make(map[string]int),
+		Index:     retrieval.New(),
+		Vocab:     make(map[string]int),
+		Meta:      newMetadata(config),
+		Backoff:   config.Backoff,
+		Smoothing: config.smoothing(),
+		config:    config,
 	}
 }
 
 // Обучение цепи Маркова на токенизированных предложениях
 func (mc *MarkovChain) Train(tokenizedSentences [][]string) error {
+	return mc.TrainDocuments([]Document{{Sentences: tokenizedSentences}})
+}
+
+// Обучение на документах корпуса; имя документа сохраняется в индексе
+// как источник предложения
+func (mc *MarkovChain) TrainDocuments(documents []Document) error {
+	tokenizedSentences := Sentences(documents)
 	if len(tokenizedSentences) == 0 {
 		return fmt.Errorf("no data to train on")
 	}
+	if err := validBackoff(mc.Backoff); err != nil {
+		return err
+	}
+	if mc.Backoff == BackoffARPA {
+		return fmt.Errorf("models with %q backoff have no counts and cannot be trained", BackoffARPA)
+	}
+	if err := mc.Smoothing.validate(); err != nil {
+		return err
+	}
+	if n := mc.config.NoveltyNGram; mc.Ngrams == nil && n != 0 && n <= mc.Order {
+		return fmt.Errorf("novelty n-gram size %d must be greater than the model order %d", n, mc.Order)
+	}
 	fmt.Printf("Training Markov chain with order %d on %d sentences...\n", mc.Order, len(tokenizedSentences))
 
-	mc.buildIndexAndVocab(tokenizedSentences)
-	for _, sentence := range tokenizedSentences {
-		mc.processSentence(sentence)
-	}
+	mc.countSentences(tokenizedSentences)
+	mc.IndexDocuments(documents)
 	mc.calculateSums()
+	if mc.TopicModel == nil && mc.config.Topics > 0 {
+		mc.trainTopics(documents)
+	}
+	if mc.TopicModel != nil {
+		mc.TopicModel.addMixtures(tokenizedSentences)
+	}
+	if mc.Ngrams == nil && mc.config.NoveltyNGram > 0 {
+		mc.Ngrams = NewNgramSet(mc.config.NoveltyNGram)
+		mc.Meta.Training.NoveltyNGram = mc.config.NoveltyNGram
+	}
+	if mc.Ngrams != nil {
+		mc.Ngrams.Add(tokenizedSentences)
+		fmt.Printf("Novelty set: %d distinct %d-grams\n", len(mc.Ngrams.Hashes), mc.Ngrams.N)
+	}
+	if mc.config.Backward || mc.Backward != nil {
+		mc.trainBackward(tokenizedSentences)
+	}
+
+	if pruning := mc.config.pruneConfig(); pruning.enabled() {
+		report := mc.Prune(pruning)
+		fmt.Printf("Pruned %d of %d transitions and %d of %d prefixes\n",
+			report.TransitionsBefore-report.TransitionsAfter, report.TransitionsBefore,
+			report.PrefixesBefore-report.PrefixesAfter, report.PrefixesBefore)
+	}
+	mc.RecomputeStats()
+	mc.Meta.TrainedAt = trainingTime()
 
 	fmt.Printf("Training completed. Chain size: %d prefixes\n", len(mc.Chain))
 	fmt.Printf("Vocabulary size: %d tokens\n", len(mc.Vocab))
-	fmt.Printf("Index size: %d words\n", len(mc.Index))
+	fmt.Printf("Index size: %d words in %d sentences\n", mc.Index.Terms(), mc.Index.Len())
 
 	return nil
 }
 
-// Строим инвертированный индекс и словарь
-func (mc *MarkovChain) buildIndexAndVocab(sentences [][]string) {
+// Подсчет переходов и словаря, последовательно или по шардам
+func (mc *MarkovChain) countSentences(sentences [][]string) {
+	if mc.config.Workers > 1 {
+		mc.trainParallel(sentences, mc.config.Workers)
+		return
+	}
+
+	mc.buildVocab(sentences)
 	for _, sentence := range sentences {
-		originalSentence := joinSentence(sentence)
+		mc.processSentence(sentence)
+	}
+}
 
+// Строим словарь
+func (mc *MarkovChain) buildVocab(sentences [][]string) {
+	for _, sentence := range sentences {
 		for _, token := range sentence {
 			if token == "<start>" || token == "<end>" {
 				continue
 			}
 			mc.Vocab[token]++
-			mc.Index[token] = append(mc.Index[token], originalSentence)
 		}
 	}
+}
 
-	for word, sentences := range mc.Index {
-		unique := make(map[string]bool)
-		var uniqueSentences []string
-		for _, s := range sentences {
-			if !unique[s] {
-				unique[s] = true
-				uniqueSentences = append(uniqueSentences, s)
-			}
+// Добавляем предложения документов в поисковый индекс, не меняя словарь
+func (mc *MarkovChain) IndexDocuments(documents []Document) {
+	for _, document := range documents {
+		for _, sentence := range document.Sentences {
+			mc.Index.Add(sentenceText(sentence), document.Name, sentence)
 		}
-		mc.Index[word] = uniqueSentences
+	}
+}
+
+// Создаем отсутствующие таблицы, чтобы модель можно было дообучать
+func (mc *MarkovChain) ensureTables() {
+	if mc.Chain == nil {
+		mc.Chain = make(map[string]map[string]int)
+	}
+	if mc.Sums == nil {
+		mc.Sums = make(map[string]int)
+	}
+	if mc.Index == nil {
+		mc.Index = retrieval.New()
+	}
+	if mc.Vocab == nil {
+		mc.Vocab = make(map[string]int)
 	}
 }
 
 // Обработка предложения и добавление его в цепь
 func (mc *MarkovChain) processSentence(sentence []string) {
+	if mc.IsVariableOrder() {
+		mc.processSentenceAllOrders(sentence)
+		return
+	}
 	if len(sentence) < mc.Order {
 		return
 	}
@@ -109,10 +235,20 @@ func (mc *MarkovChain) calculateSums() {
 		}
 		mc.Sums[prefix] = sum
 	}
+	mc.estimateKatzDiscounts()
+	mc.estimateSmoothing()
 }
 
-// Возврат возможных последующих токенов для префикса
+// Возврат возможных последующих токенов для префикса;
+// при заданной стратегии отката неизвестный префикс укорачивается
 func (mc *MarkovChain) GetNextTokens(prefix []string) map[string]float64 {
+	if mc.Smoothing != nil {
+		return mc.smoothedNextTokens(prefix)
+	}
+	if mc.IsVariableOrder() {
+		return mc.backoffNextTokens(prefix)
+	}
+
 	prefixKey := joinTokens(prefix)
 	suffixes, exists := mc.Chain[prefixKey]
 	if !exists {
@@ -129,65 +265,93 @@ func (mc *MarkovChain) GetNextTokens(prefix []string) map[string]float64 {
 	return probabilities
 }
 
-// Поиск предложений по ключевым словам
+// Поиск предложений по ключевым словам с ранжированием BM25;
+// повторяющиеся в корпусе предложения возвращаются один раз
 func (mc *MarkovChain) Search(keywords []string, limit int) []string {
-	sentenceScores := make(map[string]int)
-
-	for _, keyword := range keywords {
-		if sentences, exists := mc.Index[keyword]; exists {
-			for _, sentence := range sentences {
-				sentenceScores[sentence]++
-			}
-		}
-	}
-
-	type scoredSentence struct {
-		sentence string
-		score    int
-	}
-
-	var scored []scoredSentence
-	for sentence, score := range sentenceScores {
-		scored = append(scored, scoredSentence{sentence, score})
-	}
-
-	sort.Slice(scored, func(i, j int) bool {
-		return scored[i].score > scored[j].score
-	})
-
+	seen := make(map[string]bool)
 	var results []string
-	for i, ss := range scored {
-		if i >= limit {
+	for _, result := range mc.Index.Search(retrieval.Query{Terms: keywords}, 0) {
+		if len(results) >= limit {
 			break
 		}
-		results = append(results, ss.sentence)
+		if !seen[result.Document.Text] {
+			seen[result.Document.Text] = true
+			results = append(results, result.Document.Text)
+		}
 	}
 
 	return results
 }
 
+// Содержимое модели, защищенное контрольной суммой
+type modelPayload struct {
+	Order      int                       `json:"order"`
+	Backoff    string                    `json:"backoff,omitempty"`
+	Smoothing  *Smoothing                `json:"smoothing,omitempty"`
+	ARPA       *ARPATables               `json:"arpa,omitempty"`
+	Backward   *backwardPayload          `json:"backward,omitempty"`
+	Stats      *Stats                    `json:"stats,omitempty"`
+	Topics     map[string][]string       `json:"topics,omitempty"`
+	TopicModel *TopicModel               `json:"topic_model,omitempty"`
+	Ngrams     *NgramSet                 `json:"ngrams,omitempty"`
+	Chain      map[string]map[string]int `json:"chain"`
+	Sums       map[string]int            `json:"sums"`
+	Index      json.RawMessage           `json:"index"`
+	Vocab      map[string]int            `json:"vocab"`
+}
+
+// Файл модели: заголовок с метаданными и содержимое
+type modelFile struct {
+	Metadata *Metadata `json:"metadata,omitempty"`
+	modelPayload
+}
+
 // Сохраняем модель на диск
 func (mc *MarkovChain) Save(filepath string) error {
-	model := struct {
-		Order int                       `json:"order"`
-		Chain map[string]map[string]int `json:"chain"`
-		Sums  map[string]int            `json:"sums"`
-		Index map[string][]string       `json:"index"`
-		Vocab map[string]int            `json:"vocab"`
-	}{
-		Order: mc.Order,
-		Chain: mc.Chain,
-		Sums:  mc.Sums,
-		Index: mc.Index,
-		Vocab: mc.Vocab,
-	}
-
-	data, err := json.MarshalIndent(model, "", "  ")
+	return mc.SaveWithOptions(filepath, SaveOptions{})
+}
+
+// Сохраняем модель на диск атомарно, с ротацией резервных копий
+func (mc *MarkovChain) SaveWithOptions(filepath string, options SaveOptions) error {
+	index, err := json.Marshal(mc.Index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	payload := modelPayload{
+		Order:      mc.Order,
+		Backoff:    mc.Backoff,
+		Smoothing:  mc.Smoothing,
+		ARPA:       mc.ARPA,
+		Backward:   mc.backwardPayload(),
+		Stats:      mc.Stats,
+		Topics:     mc.Topics,
+		TopicModel: mc.TopicModel,
+		Ngrams:     mc.Ngrams,
+		Chain:      mc.Chain,
+		Sums:       mc.Sums,
+		Index:      index,
+		Vocab:      mc.Vocab,
+	}
+
+	sum, err := checksum(payload)
+	if err != nil {
+		return err
+	}
+	mc.Meta.FormatVersion = FormatVersion
+	mc.Meta.Checksum = sum
+
+	data, err := json.MarshalIndent(modelFile{Metadata: mc.Meta, modelPayload: payload}, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal model: %w", err)
 	}
 
-	err = os.WriteFile(filepath, data, 0644)
+	err = rotateBackups(filepath, options.Backups)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(filepath, data, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write model file: %w", err)
 	}
@@ -203,29 +367,48 @@ func Load(filepath string) (*MarkovChain, error) {
 		return nil, fmt.Errorf("failed to read model file: %w", err)
 	}
 
-	var model struct {
-		Order int                       `json:"order"`
-		Chain map[string]map[string]int `json:"chain"`
-		Sums  map[string]int            `json:"sums"`
-		Index map[string][]string       `json:"index"`
-		Vocab map[string]int            `json:"vocab"`
-	}
-
+	var model modelFile
 	err = json.Unmarshal(data, &model)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal model: %w", err)
 	}
 
+	if err := migrate(&model); err != nil {
+		return nil, fmt.Errorf("incompatible model %s: %w", filepath, err)
+	}
+	if err := validate(&model); err != nil {
+		return nil, fmt.Errorf("invalid model %s: %w", filepath, err)
+	}
+
 	mc := &MarkovChain{
-		Order: model.Order,
-		Chain: model.Chain,
-		Sums:  model.Sums,
-		Index: model.Index,
-		Vocab: model.Vocab,
+		Order:      model.Order,
+		Backoff:    model.Backoff,
+		Smoothing:  model.Smoothing,
+		ARPA:       model.ARPA,
+		Stats:      model.Stats,
+		Topics:     model.Topics,
+		TopicModel: model.TopicModel,
+		Ngrams:     model.Ngrams,
+		Chain:      model.Chain,
+		Sums:       model.Sums,
+		Vocab:      model.Vocab,
+		Meta:       model.Metadata,
+	}
+	if len(model.Index) > 0 {
+		if err := json.Unmarshal(model.Index, &mc.Index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+		}
 	}
+	mc.ensureTables()
+	if mc.TopicModel != nil && len(mc.TopicModel.Mixtures) != mc.Index.Len() {
+		return nil, fmt.Errorf("invalid model %s: %d topic mixtures for %d indexed sentences", filepath, len(mc.TopicModel.Mixtures), mc.Index.Len())
+	}
+	mc.estimateKatzDiscounts()
+	mc.prepareSmoothing()
+	mc.loadBackward(model.Backward)
 
-	fmt.Printf("Model loaded from %s (order: %d, chain size: %d)\n",
-		filepath, mc.Order, len(mc.Chain))
+	fmt.Printf("Model loaded from %s (order: %d, chain size: %d, format version: %d)\n",
+		filepath, mc.Order, len(mc.Chain), mc.Meta.FormatVersion)
 	return mc, nil
 }
 
@@ -238,9 +421,14 @@ func (mc *MarkovChain) GetStats() map[string]interface{} {
 
 	return map[string]interface{}{
 		"order":                      mc.Order,
+		"backoff":                    mc.Backoff,
+		"backward":                   mc.Backward != nil,
 		"prefixes":                   len(mc.Chain),
 		"vocabulary_size":            len(mc.Vocab),
-		"index_size":                 len(mc.Index),
+		"index_size":                 mc.Index.Terms(),
+		"indexed_sentences":          mc.Index.Len(),
+		"topics":                     len(mc.Topics),
+		"novelty_ngrams":             mc.Ngrams.Len(),
 		"total_transitions":          totalTransitions,
 		"avg_transitions_per_prefix": float64(totalTransitions) / float64(len(mc.Chain)),
 	}
@@ -251,6 +439,17 @@ func joinTokens(tokens []string) string {
 	return fmt.Sprintf("%v", tokens)
 }
 
+// Текст предложения без служебных токенов
+func sentenceText(tokens []string) string {
+	var words []string
+	for _, token := range tokens {
+		if token != "<start>" && token != "<end>" {
+			words = append(words, token)
+		}
+	}
+	return joinSentence(words)
+}
+
 // Объединение токенов в читаемое предложение
 func joinSentence(tokens []string) string {
 	var result string
@@ -0,0 +1,63 @@
+package trainer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"markmach/tokenizer"
+)
+
+// Небольшой корпус для тестов
+const testCorpus = `Цепь Маркова описывает систему, которая переходит из одного состояния в другое.
+Вероятность перехода зависит только от текущего состояния.
+Такое свойство называют марковским свойством или отсутствием памяти.
+Языковая модель оценивает вероятность последовательности слов.
+Биграммная модель учитывает одно предыдущее слово.
+Триграммная модель учитывает два предыдущих слова и лучше описывает контекст.
+Модель выбирает следующее слово по вероятностям переходов.
+Поиск информации помогает найти нужные предложения в корпусе текста.
+Частые слова получают малый вес, а редкие слова получают большой вес.
+Модель хорошо описывает многие процессы в природе и технике.`
+
+// Токенизированные предложения тестового корпуса
+func testSentences(t *testing.T) [][]string {
+	t.Helper()
+	tok := tokenizer.NewTokenizer(tokenizer.Config{KeepPunctuation: true, ToLowerCase: true})
+	return tok.TokenizeSentences(strings.Split(testCorpus, "\n"))
+}
+
+// Модель, обученная на тестовом корпусе
+func trainTestModel(t *testing.T, config TrainConfig) *MarkovChain {
+	t.Helper()
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	mc := NewMarkovTrainer(config)
+	if err := mc.Train(testSentences(t)); err != nil {
+		t.Fatalf("training failed: %v", err)
+	}
+	return mc
+}
+
+// Сохраненный файл модели
+func savedBytes(t *testing.T, mc *MarkovChain, name string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := mc.Save(path); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return data
+}
+
+// Модели с нормированными вероятностями, хранящие все порядки: их
+// распределения можно суммировать и переносить в ARPA
+var normalizedConfigs = map[string]TrainConfig{
+	"katz":       {Order: 3, Backoff: BackoffKatz},
+	"addk":       {Order: 3, Smoothing: SmoothingAddK, SmoothingK: 0.5},
+	"wittenbell": {Order: 3, Smoothing: SmoothingWittenBell},
+	"kneserney":  {Order: 3, Smoothing: SmoothingKneserNey},
+}